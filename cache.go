@@ -0,0 +1,188 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/docker/docker/client"
+	"sync"
+	"time"
+)
+
+// Builds clients the same way GetDockerClient does, but remembers each
+// machine's config and certs so that reconnecting doesn't spawn another
+// `docker-machine` subprocess every time. Entries are kept per machine
+// name for the factory's TTL, or until Invalidate is called.
+//
+// AutoStart, AutoRegenerateCerts and WithSSHTunnel are ignored, as they
+// would change the machine, or the way to it, behind the cached entries'
+// backs. Use a ClientFactory where they're wanted.
+//
+// A CachedClientFactory is safe for concurrent use. Goroutines asking
+// for the same uncached machine at once share a single resolution
+// rather than each running `docker-machine`.
+type CachedClientFactory struct {
+	ttl                  time.Duration
+	dockerClientSupplier DockerClientSupplier
+	options              *options
+
+	mutex     sync.Mutex
+	entries   map[string]cachedMachine
+	resolving map[string]*resolution
+}
+
+type cachedMachine struct {
+	config    DockerMachineConfig
+	tlsConfig *tls.Config
+	expires   time.Time
+}
+
+// A resolution in progress, which other goroutines wait on until done
+// is closed.
+type resolution struct {
+	done  chan struct{}
+	entry cachedMachine
+	// Set when docker-machine itself failed, so the supplier is due, if
+	// there is one, and err otherwise. A bad machine name is the
+	// caller's mistake rather than docker-machine's, so it only sets err.
+	fallback bool
+	// Set when the leader's context ended before it was done
+	abandoned bool
+	err       error
+}
+
+// Creates a factory whose entries live for the given TTL. A TTL of zero
+// or less keeps entries until Invalidate is called. As with
+// GetDockerClient, the supplier is used whenever `docker-machine` can't
+// be; those failures are not cached. A nil supplier leaves it to
+// WithFallbackSupplier, and WithFallbackDisabled turns either off, in
+// which case the `docker-machine` error is returned instead. An invalid
+// machine name, or a context ending, is always returned as an error.
+func NewCachedClientFactory(ttl time.Duration, dockerClientSupplier DockerClientSupplier, opts ...Option) *CachedClientFactory {
+	return &CachedClientFactory{
+		ttl:                  ttl,
+		dockerClientSupplier: dockerClientSupplier,
+		options:              newOptions(opts),
+		entries:              map[string]cachedMachine{},
+		resolving:            map[string]*resolution{},
+	}
+}
+
+// Returns a client for the named machine, an empty name meaning the
+// active one, resolving its config only if it isn't already cached.
+func (f *CachedClientFactory) GetDockerClient(ctx context.Context, machineName string) (*client.Client, error) {
+	for {
+		current, leader := f.join(machineName)
+		if leader {
+			f.resolve(ctx, machineName, current)
+		}
+		select {
+		case <-current.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// The leader gave up with its context, which says nothing about
+		// the machine, so whoever was waiting tries again
+		if current.abandoned && !leader {
+			continue
+		}
+		if current.fallback {
+			if supplier := f.fallbackSupplier(); supplier != nil {
+				return supplier()
+			}
+		}
+		if current.err != nil {
+			return nil, current.err
+		}
+		return f.options.newClientWithTLSConfig(ctx, machineName, current.entry.config, current.entry.tlsConfig)
+	}
+}
+
+// Joins the resolution another goroutine already started for the
+// machine, or starts one, in which case the caller is its leader and
+// must resolve it. A machine cached in the meantime comes back as a
+// resolution that's already done, checked under the same lock so that
+// a leader finishing in between can't be missed.
+func (f *CachedClientFactory) join(machineName string) (*resolution, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if entry, ok := f.lookup(machineName); ok {
+		current := &resolution{done: make(chan struct{}), entry: entry}
+		close(current.done)
+		return current, false
+	}
+	if current, ok := f.resolving[machineName]; ok {
+		return current, false
+	}
+	current := &resolution{done: make(chan struct{})}
+	f.resolving[machineName] = current
+	return current, true
+}
+
+func (f *CachedClientFactory) resolve(ctx context.Context, machineName string, current *resolution) {
+	defer func() {
+		f.mutex.Lock()
+		delete(f.resolving, machineName)
+		f.mutex.Unlock()
+		close(current.done)
+	}()
+	config, err := f.options.getDockerMachineConfig(ctx, machineName)
+	if err != nil {
+		current.err = err
+		switch {
+		case ctx.Err() != nil:
+			current.abandoned = true
+		case !errors.Is(err, ErrInvalidMachineName):
+			current.fallback = true
+		}
+		return
+	}
+	tlsConfig, err := f.options.loadTLSConfig(machineName, config)
+	if err != nil {
+		current.err = err
+		return
+	}
+	current.entry = f.store(machineName, config, tlsConfig)
+}
+
+// The supplier passed to NewCachedClientFactory, or else the one from
+// WithFallbackSupplier, unless falling back was disabled altogether.
+func (f *CachedClientFactory) fallbackSupplier() DockerClientSupplier {
+	if f.options.fallbackDisabled {
+		return nil
+	}
+	if f.dockerClientSupplier != nil {
+		return f.dockerClientSupplier
+	}
+	return f.options.fallbackSupplier
+}
+
+// Forgets every cached machine, so the next client for each of them
+// is resolved from scratch.
+func (f *CachedClientFactory) Invalidate() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.entries = map[string]cachedMachine{}
+}
+
+// Must be called with the mutex held.
+func (f *CachedClientFactory) lookup(machineName string) (cachedMachine, bool) {
+	entry, ok := f.entries[machineName]
+	if ok && f.ttl > 0 && time.Now().After(entry.expires) {
+		delete(f.entries, machineName)
+		return cachedMachine{}, false
+	}
+	return entry, ok
+}
+
+func (f *CachedClientFactory) store(machineName string, config DockerMachineConfig, tlsConfig *tls.Config) cachedMachine {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	entry := cachedMachine{
+		config:    config,
+		tlsConfig: tlsConfig,
+		expires:   time.Now().Add(f.ttl),
+	}
+	f.entries[machineName] = entry
+	return entry
+}
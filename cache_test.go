@@ -0,0 +1,135 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"errors"
+	"github.com/docker/docker/client"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func failingConfig([]string) ([]string, error) {
+	return nil, errors.New("exit status 1: Host does not exist: \"dev\"")
+}
+
+func TestCachedClientFactoryFallsBackOnOptionSupplier(t *testing.T) {
+	defer withCommandRunner(failingConfig)()
+	factory := NewCachedClientFactory(0, nil, quietLogger, WithFallbackSupplier(NoopSupplier))
+	dockerClient, err := factory.GetDockerClient(context.Background(), "dev")
+	mustNotError(t, err)
+	if host := dockerClient.DaemonHost(); host != noopHost {
+		t.Errorf("expected the fallback supplier's host, got %q", host)
+	}
+}
+
+func TestCachedClientFactoryWithoutSupplier(t *testing.T) {
+	defer withCommandRunner(failingConfig)()
+	for name, factory := range map[string]*CachedClientFactory{
+		"nil supplier":      NewCachedClientFactory(0, nil, quietLogger),
+		"fallback disabled": NewCachedClientFactory(0, NoopSupplier, quietLogger, WithFallbackDisabled(true)),
+	} {
+		dockerClient, err := factory.GetDockerClient(context.Background(), "dev")
+		if !errors.Is(err, ErrDockerMachineConfigFailed) {
+			t.Errorf("%s: expected ErrDockerMachineConfigFailed, got %v", name, err)
+		}
+		if dockerClient != nil {
+			t.Errorf("%s: expected no client", name)
+		}
+	}
+}
+
+func TestCachedClientFactoryResolvesOnce(t *testing.T) {
+	server := httptest.NewServer(versionHandler("1.40"))
+	defer server.Close()
+	var runs int32
+	config := configRunner("-H=tcp://" + server.Listener.Addr().String())
+	defer withCommandRunner(func(args []string) ([]string, error) {
+		if args[0] == "config" {
+			atomic.AddInt32(&runs, 1)
+			// Long enough for every goroutine to ask before it's done
+			time.Sleep(50 * time.Millisecond)
+		}
+		return config(args)
+	})()
+	factory := NewCachedClientFactory(time.Minute, nil, quietLogger)
+	wait := sync.WaitGroup{}
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			_, err := factory.GetDockerClient(context.Background(), "dev")
+			errs <- err
+		}()
+	}
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		mustNotError(t, err)
+	}
+	if runs != 1 {
+		t.Errorf("expected docker-machine to run once, it ran %d times", runs)
+	}
+	if _, err := factory.GetDockerClient(context.Background(), "dev"); err != nil || runs != 1 {
+		t.Errorf("expected the cached config to be used, ran %d times (%v)", runs, err)
+	}
+	factory.Invalidate()
+	if _, err := factory.GetDockerClient(context.Background(), "dev"); err != nil || runs != 2 {
+		t.Errorf("expected a fresh resolution after Invalidate, ran %d times (%v)", runs, err)
+	}
+}
+
+func TestCachedClientFactoryInvalidName(t *testing.T) {
+	defer withCommandRunner(failingConfig)()
+	factory := NewCachedClientFactory(0, NoopSupplier, quietLogger)
+	dockerClient, err := factory.GetDockerClient(context.Background(), "bad\nname")
+	if !errors.Is(err, ErrInvalidMachineName) || dockerClient != nil {
+		t.Errorf("expected ErrInvalidMachineName rather than the fallback, got %v", err)
+	}
+}
+
+func TestCachedClientFactoryCancelledLeader(t *testing.T) {
+	server := httptest.NewServer(versionHandler("1.40"))
+	defer server.Close()
+	host := "tcp://" + server.Listener.Addr().String()
+	started := make(chan struct{})
+	var runs int32
+	defer func(old func(context.Context, []string, string, ...string) ([]string, error)) { commandRunner = old }(commandRunner)
+	commandRunner = func(ctx context.Context, _ []string, _ string, _ ...string) ([]string, error) {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return []string{"-H=" + host}, nil
+	}
+	factory := NewCachedClientFactory(0, NoopSupplier, quietLogger)
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, err := factory.GetDockerClient(leaderCtx, "dev")
+		leaderErr <- err
+	}()
+	<-started
+	waiterDone := make(chan struct{})
+	var dockerClient *client.Client
+	var err error
+	go func() {
+		defer close(waiterDone)
+		dockerClient, err = factory.GetDockerClient(context.Background(), "dev")
+	}()
+	// Give the waiter time to join before the leader gives up
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the leader to be cancelled, got %v", err)
+	}
+	<-waiterDone
+	mustNotError(t, err)
+	if dockerClient.DaemonHost() != host {
+		t.Errorf("expected the waiter to resolve the machine itself, got %q", dockerClient.DaemonHost())
+	}
+}
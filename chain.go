@@ -0,0 +1,94 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/client"
+	"strings"
+)
+
+// Tries `docker-machine` and then each supplier in turn, returning the
+// first client that could be built. If they all fail, the error lists
+// every supplier's failure.
+func GetDockerClientChain(suppliers ...DockerClientSupplier) (*client.Client, error) {
+	return GetDockerClient(ChainSuppliers(suppliers...))
+}
+
+// Combines suppliers into one that tries each in order and stops at the
+// first success. Wrap a supplier with PingSupplier for "success" to mean
+// the daemon actually answered.
+func ChainSuppliers(suppliers ...DockerClientSupplier) DockerClientSupplier {
+	return func() (*client.Client, error) {
+		failures := &chainError{}
+		for _, supplier := range suppliers {
+			dockerClient, err := supplier()
+			if err == nil {
+				return dockerClient, nil
+			}
+			failures.errs = append(failures.errs, err)
+		}
+		if len(failures.errs) == 0 {
+			return nil, fmt.Errorf("no docker client suppliers given")
+		}
+		return nil, failures
+	}
+}
+
+// Wraps a supplier so that a client whose daemon doesn't answer a ping
+// is closed and reported as ErrDaemonUnreachable instead.
+func PingSupplier(ctx context.Context, supplier DockerClientSupplier) DockerClientSupplier {
+	return func() (*client.Client, error) {
+		dockerClient, err := supplier()
+		if err != nil {
+			return nil, err
+		}
+		if err := pingClient(ctx, dockerClient); err != nil {
+			return nil, err
+		}
+		return dockerClient, nil
+	}
+}
+
+// A supplier that always returns the given client, for injecting a
+// client of the test's choosing as the fallback in downstream tests.
+func NewMockSupplier(dockerClient *client.Client) DockerClientSupplier {
+	return func() (*client.Client, error) {
+		return dockerClient, nil
+	}
+}
+
+// A supplier of clients pointed at an address nothing listens on, for
+// tests that need a client but no daemon. Building one always succeeds,
+// while every request through it fails straight away.
+func NoopSupplier() (*client.Client, error) {
+	return client.NewClientWithOpts(
+		client.WithHost(noopHost),
+		client.WithVersion(api.DefaultVersion),
+	)
+}
+
+// Port 0 can't be connected to, so requests fail without a timeout.
+const noopHost = "tcp://127.0.0.1:0"
+
+// Closes the client if its daemon doesn't answer.
+func pingClient(ctx context.Context, dockerClient *client.Client) error {
+	if _, err := dockerClient.Ping(ctx); err != nil {
+		dockerClient.Close()
+		return &causedError{kind: ErrDaemonUnreachable, cause: err}
+	}
+	return nil
+}
+
+// Every failure from a chain of suppliers, in the order they were tried.
+type chainError struct {
+	errs []error
+}
+
+func (e *chainError) Error() string {
+	messages := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		messages[i] = fmt.Sprintf("supplier %d: %s", i+1, err)
+	}
+	return "all docker client suppliers failed: " + strings.Join(messages, "; ")
+}
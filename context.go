@@ -0,0 +1,65 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// The parts of `docker context inspect` we need. The TLS files live
+// under Storage.TLSPath, in a directory per endpoint, and TLSMaterial
+// lists which of them the endpoint has.
+type dockerContextInspection struct {
+	Name      string
+	Endpoints map[string]struct {
+		Host          string
+		SkipTLSVerify bool
+	}
+	TLSMaterial map[string][]string
+	Storage     struct {
+		TLSPath string
+	}
+}
+
+// Returns a config source backed by the named docker context rather
+// than a docker-machine, so GetDockerClient can connect through
+// `docker context` with the same cert loading and version probing.
+func dockerContextSource(contextName string) func(*options, context.Context, string) (DockerMachineConfig, error) {
+	return func(o *options, ctx context.Context, _ string) (DockerMachineConfig, error) {
+		items, err := commandRunner(ctx, nil, o.dockerBinaryPath, "context", "inspect", contextName, "--format", "{{json .}}")
+		if err != nil {
+			return DockerMachineConfig{}, fmt.Errorf("could not inspect docker context %q: %w", contextName, err)
+		}
+		return parseDockerContext(strings.Join(items, "\n"))
+	}
+}
+
+func parseDockerContext(output string) (DockerMachineConfig, error) {
+	inspection := dockerContextInspection{}
+	if err := json.Unmarshal([]byte(output), &inspection); err != nil {
+		return DockerMachineConfig{}, fmt.Errorf("could not parse docker context: %w", err)
+	}
+	endpoint, ok := inspection.Endpoints["docker"]
+	if !ok || endpoint.Host == "" {
+		return DockerMachineConfig{}, fmt.Errorf("docker context %q has no docker endpoint", inspection.Name)
+	}
+	config := DockerMachineConfig{URL: endpoint.Host}
+	tlsPath := filepath.Join(inspection.Storage.TLSPath, "docker")
+	for _, file := range inspection.TLSMaterial["docker"] {
+		switch file {
+		case "ca.pem":
+			config.TLSCaCert = filepath.Join(tlsPath, file)
+		case "cert.pem":
+			config.TLSCert = filepath.Join(tlsPath, file)
+		case "key.pem":
+			config.TLSKey = filepath.Join(tlsPath, file)
+		}
+	}
+	// A context skipping verification still speaks TLS, so TLSVerify
+	// means TLS is used at all and skipVerify the rest
+	config.TLSVerify = config.TLSCaCert != "" || config.TLSCert != ""
+	config.skipVerify = endpoint.SkipTLSVerify
+	return config, nil
+}
@@ -0,0 +1,57 @@
+package docker_machine_helper
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDockerContext(t *testing.T) {
+	tlsPath := filepath.FromSlash("/home/dev/.docker/contexts/tls/2b3e6f14")
+	for _, test := range []struct {
+		name     string
+		output   string
+		expected DockerMachineConfig
+		err      string
+	}{
+		{
+			name:   "tls material",
+			output: `{"Name":"remote","Metadata":{"Description":"remote daemon"},"Endpoints":{"docker":{"Host":"tcp://192.168.99.100:2376","SkipTLSVerify":false}},"TLSMaterial":{"docker":["ca.pem","cert.pem","key.pem"]},"Storage":{"MetadataPath":"/home/dev/.docker/contexts/meta/2b3e6f14","TLSPath":"` + filepath.ToSlash(tlsPath) + `"}}`,
+			expected: DockerMachineConfig{
+				URL:       "tcp://192.168.99.100:2376",
+				TLSVerify: true,
+				TLSCaCert: filepath.Join(tlsPath, "docker", "ca.pem"),
+				TLSCert:   filepath.Join(tlsPath, "docker", "cert.pem"),
+				TLSKey:    filepath.Join(tlsPath, "docker", "key.pem"),
+			},
+		},
+		{
+			name:   "skip tls verify",
+			output: `{"Name":"lab","Metadata":{},"Endpoints":{"docker":{"Host":"tcp://10.0.0.5:2376","SkipTLSVerify":true}},"TLSMaterial":{"docker":["cert.pem","key.pem"]},"Storage":{"MetadataPath":"/home/dev/.docker/contexts/meta/2b3e6f14","TLSPath":"` + filepath.ToSlash(tlsPath) + `"}}`,
+			expected: DockerMachineConfig{
+				URL:        "tcp://10.0.0.5:2376",
+				TLSVerify:  true,
+				TLSCert:    filepath.Join(tlsPath, "docker", "cert.pem"),
+				TLSKey:     filepath.Join(tlsPath, "docker", "key.pem"),
+				skipVerify: true,
+			},
+		},
+		{
+			name:   "no docker endpoint",
+			output: `{"Name":"k8s-only","Metadata":{},"Endpoints":{"kubernetes":{"Host":"https://10.0.0.1:6443","SkipTLSVerify":false}},"TLSMaterial":{},"Storage":{"MetadataPath":"<IN MEMORY>","TLSPath":"<IN MEMORY>"}}`,
+			err:    `docker context "k8s-only" has no docker endpoint`,
+		},
+	} {
+		config, err := parseDockerContext(test.output)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		mustNotError(t, err)
+		if config != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, config)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+// Builds docker clients for docker-machine VMs, from the endpoint and
+// certs `docker-machine` reports, falling back onto a supplier of your
+// choice when it can't be used.
+//
+// Clients are only ever built with client.NewClientWithOpts, never the
+// deprecated NewClient and NewEnvClient. The package is built and tested
+// against github.com/docker/docker v20.10.24, the version in go.mod.
+// v1.13.1, the newest release before v20.10 that Go modules resolve,
+// has no NegotiateAPIVersionPing, so it won't build against it.
+package docker_machine_helper
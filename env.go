@@ -0,0 +1,160 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/client"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A config source parsing the shell exports of
+// `docker-machine env --shell bash`, such as
+// `export DOCKER_HOST="tcp://192.168.99.100:2376"`.
+func (o *options) configFromEnvCommand(ctx context.Context, machineName string) (DockerMachineConfig, error) {
+	items, err := o.getConfigOutputFromDockerMachine(ctx, machineName, "env", "--shell", "bash")
+	if err != nil {
+		return DockerMachineConfig{}, err
+	}
+	config := configFromEnvVars(parseDockerMachineEnv(items))
+	if config.URL == "" {
+		return DockerMachineConfig{}, unparseableConfigError(machineName, items)
+	}
+	return config, nil
+}
+
+func (o *options) rawConfigFromEnvCommand(ctx context.Context, machineName string) (map[string]string, error) {
+	items, err := o.getConfigOutputFromDockerMachine(ctx, machineName, "env", "--shell", "bash")
+	if err != nil {
+		return nil, err
+	}
+	return parseDockerMachineEnv(items), nil
+}
+
+// A config source reading the variables an eval'd `docker-machine env`
+// leaves behind, so no subprocess is needed. Without DOCKER_HOST, or
+// when they describe a different machine than the one asked for, it
+// falls back onto `docker-machine config`.
+func (o *options) configFromProcessEnv(ctx context.Context, machineName string) (DockerMachineConfig, error) {
+	vars := map[string]string{}
+	for _, key := range []string{"DOCKER_HOST", "DOCKER_TLS_VERIFY", "DOCKER_CERT_PATH", "DOCKER_MACHINE_NAME"} {
+		vars[key] = os.Getenv(key)
+	}
+	if vars["DOCKER_HOST"] == "" || (machineName != "" && machineName != vars["DOCKER_MACHINE_NAME"]) {
+		return o.configFromConfigCommand(ctx, machineName)
+	}
+	return configFromEnvVars(vars), nil
+}
+
+// Collects the `export KEY=VALUE` lines, ignoring the comments
+// docker-machine prints after them.
+func parseDockerMachineEnv(outputItems []string) map[string]string {
+	vars := map[string]string{}
+	for _, line := range outputItems {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "export ") {
+			continue
+		}
+		stuff := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		if len(stuff) < 2 {
+			continue
+		}
+		vars[strings.TrimSpace(stuff[0])] = strings.Trim(strings.TrimSpace(stuff[1]), `"'`)
+	}
+	return vars
+}
+
+// Maps the DOCKER_* variables onto a config, the certs being the
+// ca.pem, cert.pem and key.pem docker-machine keeps in DOCKER_CERT_PATH.
+// As with client.FromEnv, a cert path means TLS even when
+// DOCKER_TLS_VERIFY is empty, only without verifying the daemon.
+func configFromEnvVars(vars map[string]string) DockerMachineConfig {
+	config := DockerMachineConfig{
+		URL:       vars["DOCKER_HOST"],
+		TLSVerify: vars["DOCKER_TLS_VERIFY"] != "",
+	}
+	if certPath := vars["DOCKER_CERT_PATH"]; certPath != "" {
+		config.TLSCaCert = filepath.Join(certPath, "ca.pem")
+		config.TLSCert = filepath.Join(certPath, "cert.pem")
+		config.TLSKey = filepath.Join(certPath, "key.pem")
+		if !config.TLSVerify {
+			config.TLSVerify = true
+			config.skipVerify = true
+		}
+	}
+	return config
+}
+
+// Falls back onto a client built from DOCKER_HOST and DOCKER_CERT_PATH
+// with the same TLS construction as a machine's, so the options apply
+// alike to both. Without DOCKER_HOST it's EnvClientSupplier, provided
+// the default socket is there, and otherwise ErrNoDockerEndpoint rather
+// than a client that fails on first use.
+func withEnvFallback() Option {
+	return func(o *options) {
+		o.fallbackSupplier = func() (*client.Client, error) {
+			if os.Getenv("DOCKER_HOST") == "" {
+				if !defaultHostExists() {
+					return nil, fmt.Errorf("%w: DOCKER_HOST is unset and there is nothing at %s", ErrNoDockerEndpoint, client.DefaultDockerHost)
+				}
+				return EnvClientSupplier()
+			}
+			config := configFromEnvVars(map[string]string{
+				"DOCKER_HOST":       os.Getenv("DOCKER_HOST"),
+				"DOCKER_TLS_VERIFY": os.Getenv("DOCKER_TLS_VERIFY"),
+				"DOCKER_CERT_PATH":  os.Getenv("DOCKER_CERT_PATH"),
+			})
+			dockerClient, err := o.newClientFromConfig(context.Background(), "", config)
+			if err != nil {
+				return nil, fmt.Errorf("could not use DOCKER_HOST: %w", err)
+			}
+			return dockerClient, nil
+		}
+	}
+}
+
+// The DOCKER_* variables `eval $(docker-machine env)` would set for the
+// named machine, an empty name meaning the active one, ready to add to
+// a subprocess's environment. DOCKER_TLS_VERIFY and DOCKER_CERT_PATH
+// are left out for machines that don't use TLS. The docker cli expects
+// the certs in DOCKER_CERT_PATH to be named ca.pem, cert.pem and
+// key.pem, as docker-machine names them.
+func EnvVars(machineName string, opts ...Option) (map[string]string, error) {
+	o := newOptions(opts)
+	ctx := context.Background()
+	config, err := o.getDockerMachineConfig(ctx, machineName)
+	if err != nil {
+		return nil, err
+	}
+	if machineName == "" {
+		items, err := o.getOutputItemsFromDockerMachine(ctx, "active")
+		if err != nil {
+			return nil, fmt.Errorf("could not find the active machine's name: %w", err)
+		}
+		machineName = strings.TrimSpace(strings.Join(items, ""))
+	}
+	vars := map[string]string{
+		"DOCKER_HOST":         config.URL,
+		"DOCKER_MACHINE_NAME": machineName,
+	}
+	if config.TLSVerify {
+		vars["DOCKER_TLS_VERIFY"] = "1"
+		if config.TLSCert != "" {
+			vars["DOCKER_CERT_PATH"] = filepath.Dir(config.TLSCert)
+		}
+	}
+	return vars, nil
+}
+
+// Whether the socket, or named pipe on Windows, the docker client uses
+// without DOCKER_HOST is there to connect to.
+func defaultHostExists() bool {
+	hostURL, err := client.ParseHostURL(client.DefaultDockerHost)
+	if err != nil || !isSocketProto(hostURL.Scheme) {
+		return true
+	}
+	// The socket's path is kept as the host, as for the transport's dialer
+	_, err = os.Stat(hostURL.Host)
+	return err == nil
+}
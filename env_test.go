@@ -0,0 +1,103 @@
+package docker_machine_helper
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigFromEnvVars(t *testing.T) {
+	certPath := filepath.FromSlash("/machine/certs")
+	for _, test := range []struct {
+		name       string
+		vars       map[string]string
+		tlsVerify  bool
+		skipVerify bool
+	}{
+		{"plain", map[string]string{"DOCKER_HOST": "tcp://host:2375"}, false, false},
+		{"verified", map[string]string{"DOCKER_HOST": "tcp://host:2376", "DOCKER_TLS_VERIFY": "1", "DOCKER_CERT_PATH": certPath}, true, false},
+		{"unverified", map[string]string{"DOCKER_HOST": "tcp://host:2376", "DOCKER_CERT_PATH": certPath}, true, true},
+	} {
+		config := configFromEnvVars(test.vars)
+		if config.TLSVerify != test.tlsVerify || config.skipVerify != test.skipVerify {
+			t.Errorf("%s: expected TLSVerify %t and skipVerify %t, got %+v", test.name, test.tlsVerify, test.skipVerify, config)
+		}
+	}
+	config := configFromEnvVars(map[string]string{"DOCKER_CERT_PATH": certPath})
+	if config.TLSKey != filepath.Join(certPath, "key.pem") {
+		t.Errorf("expected the key in the cert path, got %q", config.TLSKey)
+	}
+}
+
+func notInstalled([]string) ([]string, error) {
+	return nil, &exec.Error{Name: "docker-machine", Err: exec.ErrNotFound}
+}
+
+func TestEnvFallbackTLSWithoutVerify(t *testing.T) {
+	defer withCommandRunner(notInstalled)()
+	// Signed by a CA the client has never heard of
+	server := httptest.NewTLSServer(versionHandler("1.40"))
+	defer server.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	newTestPKI(t).writeCerts(t, dir)
+	defer setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())()
+	defer setenv("DOCKER_CERT_PATH", dir)()
+	defer setenv("DOCKER_TLS_VERIFY", "")()
+
+	dockerClient, err := GetDockerClientEnvFallback(quietLogger)
+	mustNotError(t, err)
+	if version := dockerClient.ClientVersion(); version != "1.40" {
+		t.Errorf("expected to probe over TLS without verifying, got %q", version)
+	}
+
+	defer setenv("DOCKER_TLS_VERIFY", "1")()
+	if _, err := GetDockerClientEnvFallback(quietLogger); !errors.Is(err, ErrTLSHandshake) {
+		t.Errorf("expected the unknown CA to fail verification, got %v", err)
+	}
+}
+
+func TestEnvVarsForTLSMachine(t *testing.T) {
+	certDir := filepath.FromSlash("/home/dev/.docker/machine/machines/dev")
+	config := configRunner(
+		`--tlsverify`,
+		`--tlscacert="`+filepath.Join(certDir, "ca.pem")+`"`,
+		`--tlscert="`+filepath.Join(certDir, "cert.pem")+`"`,
+		`--tlskey="`+filepath.Join(certDir, "key.pem")+`"`,
+		`-H=tcp://192.168.99.100:2376`,
+	)
+	defer withCommandRunner(func(args []string) ([]string, error) {
+		if args[0] == "active" {
+			return []string{"dev"}, nil
+		}
+		return config(args)
+	})()
+	expected := map[string]string{
+		"DOCKER_HOST":         "tcp://192.168.99.100:2376",
+		"DOCKER_TLS_VERIFY":   "1",
+		"DOCKER_CERT_PATH":    certDir,
+		"DOCKER_MACHINE_NAME": "dev",
+	}
+	for _, machineName := range []string{"", "dev"} {
+		vars, err := EnvVars(machineName, quietLogger)
+		mustNotError(t, err)
+		if !reflect.DeepEqual(vars, expected) {
+			t.Errorf("%q: expected %v, got %v", machineName, expected, vars)
+		}
+	}
+}
+
+func TestNoDockerEndpoint(t *testing.T) {
+	if defaultHostExists() {
+		t.Skip("there is a daemon at the default host")
+	}
+	defer withCommandRunner(notInstalled)()
+	defer setenv("DOCKER_HOST", "")()
+	_, err := GetDockerClientEnvFallback(quietLogger)
+	if !errors.Is(err, ErrNoDockerEndpoint) {
+		t.Errorf("expected ErrNoDockerEndpoint, got %v", err)
+	}
+}
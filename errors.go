@@ -0,0 +1,116 @@
+package docker_machine_helper
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	// The `docker-machine` binary could not be found or started.
+	ErrDockerMachineNotInstalled = errors.New("docker-machine is not installed")
+	// `docker-machine config` ran but did not succeed, for instance
+	// because the machine does not exist or is stopped.
+	ErrDockerMachineConfigFailed = errors.New("docker-machine config failed")
+	// `docker-machine` doesn't know of a machine by that name.
+	ErrMachineNotFound = errors.New("machine does not exist")
+	// The machine's client cert has expired, or will within the window
+	// given to WithCertExpiryWindow.
+	ErrCertExpiringSoon = errors.New("client certificate expired or expiring soon")
+	// The machine name is blank or contains control characters.
+	ErrInvalidMachineName = errors.New("invalid machine name")
+	// The client was built, but the daemon behind it didn't answer.
+	ErrDaemonUnreachable = errors.New("docker daemon not reachable")
+	// No machine name was given and `docker-machine` has no active or
+	// default machine to use instead. Errors of this kind are also
+	// ErrDockerMachineConfigFailed.
+	ErrNoActiveMachine = errors.New("no active docker machine")
+	// The daemon's API version is outside the range given to
+	// WithMinAPIVersion and WithMaxAPIVersion, and StrictAPIVersionRange
+	// was asked for.
+	ErrAPIVersionOutOfRange = errors.New("docker API version out of range")
+	// The daemon's certificate couldn't be verified, or the daemon didn't
+	// speak TLS at all, often because the machine's certs no longer
+	// match its address and need regenerating.
+	ErrTLSHandshake = errors.New("TLS handshake with docker daemon failed")
+	// The docker host's name doesn't resolve, found out up front because
+	// WithPreflightDNS was asked for.
+	ErrHostUnresolvable = errors.New("docker host does not resolve")
+	// `docker-machine` succeeded, but nothing in its output said where
+	// the daemon is. The error includes the output.
+	ErrUnparseableConfig = errors.New("unparseable docker-machine config")
+	// Neither `docker-machine` nor the environment says where a daemon
+	// is: DOCKER_HOST is unset and the default socket doesn't exist.
+	ErrNoDockerEndpoint = errors.New("no docker endpoint")
+)
+
+// Pairs one of the sentinel errors above with the error that caused
+// it, so that errors.Is matches the sentinel while errors.As can still
+// reach the underlying cause (such as an *exec.ExitError).
+type causedError struct {
+	kind  error
+	cause error
+}
+
+func (e *causedError) Error() string {
+	return fmt.Sprintf("%s: %s", e.kind, e.cause)
+}
+
+func (e *causedError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *causedError) Unwrap() error {
+	return e.cause
+}
+
+// Whether the error came from failing to set up or verify TLS, as
+// happens when a machine's certs no longer match its address.
+func isTLSError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var recordHeader tls.RecordHeaderError
+	return errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &invalid) ||
+		errors.As(err, &recordHeader) ||
+		// net/http turns the RecordHeaderError from a plain http daemon
+		// into an error of its own, with nothing but its message to go by
+		strings.Contains(err.Error(), "server gave HTTP response to HTTPS client")
+}
+
+// Whether the error came from failing to connect at all, as opposed to
+// the daemon or its certs turning the connection down.
+func isDialError(err error) bool {
+	var opError *net.OpError
+	return errors.As(err, &opError) && opError.Op == "dial"
+}
+
+// Marks TLS failures as ErrTLSHandshake, leaving other errors alone.
+func tlsHandshakeError(err error) error {
+	if err != nil && isTLSError(err) {
+		return &causedError{kind: ErrTLSHandshake, cause: err}
+	}
+	return err
+}
+
+// What docker-machine says on stderr when asked about the active
+// machine and there is none: the first from `active`, the second from
+// commands like `config` that fall back onto the "default" machine.
+var noActiveMachineMessages = []string{
+	"No active host found",
+	`no "default" machine exists`,
+}
+
+func isNoActiveMachine(err error) bool {
+	for _, message := range noActiveMachineMessages {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package docker_machine_helper
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTLSHandshakeError(t *testing.T) {
+	pki := newTestPKI(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	pki.writeCerts(t, dir)
+
+	// A daemon whose cert the machine's CA never signed
+	wrongCA := httptest.NewTLSServer(versionHandler("1.40"))
+	defer wrongCA.Close()
+	_, err := NewClientFromConfig(tlsMachineConfig(dir, wrongCA), quietLogger, WithIsolatedTrust(true))
+	if !errors.Is(err, ErrTLSHandshake) {
+		t.Errorf("expected ErrTLSHandshake, got %v", err)
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	if !errors.As(err, &unknownAuthority) {
+		t.Errorf("expected the x509 cause to be kept, got %v", err)
+	}
+
+	// A daemon that doesn't speak TLS at all
+	plain := httptest.NewServer(versionHandler("1.40"))
+	defer plain.Close()
+	_, err = NewClientFromConfig(tlsMachineConfig(dir, plain), quietLogger)
+	if !errors.Is(err, ErrTLSHandshake) {
+		t.Errorf("expected ErrTLSHandshake, got %v", err)
+	}
+
+	// Reached, but not a handshake problem
+	right := pki.tlsServer(versionHandler("1.40"))
+	right.Close()
+	_, err = NewClientFromConfig(tlsMachineConfig(dir, right), quietLogger)
+	if err == nil || errors.Is(err, ErrTLSHandshake) {
+		t.Errorf("expected a closed daemon not to be ErrTLSHandshake, got %v", err)
+	}
+}
+
+func TestUnparseableConfig(t *testing.T) {
+	defer withCommandRunner(configRunner("Something changed in docker-machine", "--colour=always"))()
+	_, err := ResolveConfig("dev", quietLogger)
+	if !errors.Is(err, ErrUnparseableConfig) {
+		t.Fatalf("expected ErrUnparseableConfig, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "Something changed in docker-machine") {
+		t.Errorf("expected the output in the error, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"errors"
+	"github.com/docker/docker/client"
+)
+
+// Builds docker clients according to a fixed set of options. The
+// package-level GetDockerClient functions are shorthands for a factory
+// made on the spot, so a factory is the place to start once more than
+// one or two options are involved. A ClientFactory is safe for
+// concurrent use, as its options never change once it's made.
+type ClientFactory struct {
+	options *options
+}
+
+// Creates a factory from the given options. Without
+// WithFallbackSupplier, failing to use `docker-machine` is returned as
+// an error rather than falling back to anything.
+func NewClientFactory(opts ...Option) *ClientFactory {
+	return &ClientFactory{options: newOptions(opts)}
+}
+
+// Connects to the configured machine through `docker-machine`, falling
+// back onto the fallback supplier, if there is one, when `docker-machine`
+// can't be used.
+func (f *ClientFactory) Client(ctx context.Context) (*client.Client, error) {
+	dockerClient, _, err := f.ClientWithConfig(ctx)
+	return dockerClient, err
+}
+
+// The same as Client, but also returns the config the client was built
+// from, along with the API version the client settled on. When the
+// fallback supplier was used instead, the config is empty apart from
+// UsedFallback and APIVersion.
+func (f *ClientFactory) ClientWithConfig(ctx context.Context) (*client.Client, DockerMachineConfig, error) {
+	o := f.options
+	if err := o.ensureMachineRunning(ctx, o.machineName); err != nil {
+		return nil, DockerMachineConfig{}, err
+	}
+	dockerMachineConfig, err := o.getDockerMachineConfig(ctx, o.machineName)
+	if err != nil {
+		// The call to docker-machine failed, which means we can fall back
+		// to our alternate client supplier, if we were given one
+		if o.fallbackSupplier == nil || o.fallbackDisabled {
+			return nil, DockerMachineConfig{}, err
+		}
+		dockerClient, err := o.fallbackSupplier()
+		return dockerClient, withAPIVersion(DockerMachineConfig{UsedFallback: true}, dockerClient), err
+	}
+	dockerMachineConfig.MachineName = o.machineName
+	dockerClient, err := o.newClientFromConfig(ctx, o.machineName, dockerMachineConfig)
+	if err != nil && o.autoRegenerateCerts && isTLSError(err) {
+		return f.clientWithRegeneratedCerts(ctx, err)
+	}
+	// A probe that timed out, while the caller's context hasn't, most
+	// likely never got a connection either
+	if err != nil && o.sshTunnel && (isDialError(err) || errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil) {
+		dockerClient, err = o.clientOverSSHTunnel(ctx, o.machineName, dockerMachineConfig, err)
+	}
+	return dockerClient, withAPIVersion(dockerMachineConfig, dockerClient), err
+}
+
+// Records the version the client will speak, whether pinned, probed or
+// negotiated. A nil client, from a failed attempt, leaves it empty.
+func withAPIVersion(dockerMachineConfig DockerMachineConfig, dockerClient *client.Client) DockerMachineConfig {
+	if dockerClient != nil {
+		dockerMachineConfig.APIVersion = dockerClient.ClientVersion()
+	}
+	return dockerMachineConfig
+}
+
+// Regenerates the machine's certs once after a TLS failure, then tries
+// again with whatever config `docker-machine` reports afterwards.
+func (f *ClientFactory) clientWithRegeneratedCerts(ctx context.Context, tlsErr error) (*client.Client, DockerMachineConfig, error) {
+	o := f.options
+	o.logger.Printf("Regenerating certs for %s after: %s", describeMachine(o.machineName), tlsErr)
+	if err := o.regenerateCerts(ctx, o.machineName); err != nil {
+		return nil, DockerMachineConfig{}, err
+	}
+	dockerMachineConfig, err := o.getDockerMachineConfig(ctx, o.machineName)
+	if err != nil {
+		return nil, DockerMachineConfig{}, err
+	}
+	dockerMachineConfig.MachineName = o.machineName
+	dockerClient, err := o.newClientFromConfig(ctx, o.machineName, dockerMachineConfig)
+	return dockerClient, withAPIVersion(dockerMachineConfig, dockerClient), err
+}
@@ -0,0 +1,72 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestFactoryNoActiveMachine(t *testing.T) {
+	defer withCommandRunner(func([]string) ([]string, error) {
+		return nil, errors.New("exit status 1: No active host found")
+	})()
+	_, err := NewClientFactory(quietLogger).Client(context.Background())
+	if !errors.Is(err, ErrNoActiveMachine) {
+		t.Errorf("expected ErrNoActiveMachine, got %v", err)
+	}
+	// With a fallback the state is still handled, by falling back
+	dockerClient, config, err := NewClientFactory(quietLogger, WithFallbackSupplier(NoopSupplier)).ClientWithConfig(context.Background())
+	mustNotError(t, err)
+	if !config.UsedFallback || dockerClient.DaemonHost() != noopHost {
+		t.Errorf("expected the fallback to be used, got %+v", config)
+	}
+}
+
+func TestAutoRegenerateCerts(t *testing.T) {
+	pki := newTestPKI(t)
+	server := pki.tlsServer(versionHandler("1.40"))
+	defer server.Close()
+	good, cleanupGood := tempDir(t)
+	defer cleanupGood()
+	pki.writeCerts(t, good)
+	// Certs from before the machine's were last regenerated
+	stale, cleanupStale := tempDir(t)
+	defer cleanupStale()
+	newTestPKI(t).writeCerts(t, stale)
+
+	for _, fixes := range []bool{true, false} {
+		dir := stale
+		var regenerations [][]string
+		configs := 0
+		restore := withCommandRunner(func(args []string) ([]string, error) {
+			switch args[0] {
+			case "regenerate-certs":
+				regenerations = append(regenerations, args)
+				if fixes {
+					dir = good
+				}
+				return []string{"Regenerating TLS certificates"}, nil
+			case "config":
+				configs++
+				config := tlsMachineConfig(dir, server)
+				return []string{"--tlsverify", "--tlscacert=" + config.TLSCaCert, "--tlscert=" + config.TLSCert, "--tlskey=" + config.TLSKey, "-H=" + config.URL}, nil
+			}
+			return nil, fmt.Errorf("exit status 1: cannot run %q here", args)
+		})
+		_, err := NewClientFactory(quietLogger, WithMachineName("dev"), WithIsolatedTrust(true), AutoRegenerateCerts(true)).Client(context.Background())
+		restore()
+		if fixes {
+			mustNotError(t, err)
+		} else if !errors.Is(err, ErrTLSHandshake) {
+			t.Errorf("expected the handshake to fail again, got %v", err)
+		}
+		if !reflect.DeepEqual(regenerations, [][]string{{"regenerate-certs", "-f", "dev"}}) {
+			t.Errorf("expected a single regenerate-certs -f dev, got %q", regenerations)
+		}
+		if configs != 2 {
+			t.Errorf("expected the config resolved again after regenerating, got %d runs", configs)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stands in for commandRunner, so tests can decide what `docker-machine`
+// answers without the binary being installed.
+type cannedRunner func(args []string) ([]string, error)
+
+// Swaps commandRunner for the canned one until the returned func is
+// called, which tests defer.
+func withCommandRunner(runner cannedRunner) func() {
+	old := commandRunner
+	commandRunner = func(_ context.Context, _ []string, _ string, args ...string) ([]string, error) {
+		return runner(args)
+	}
+	return func() { commandRunner = old }
+}
+
+// A logger that discards everything, so tests stay quiet.
+var quietLogger = WithLogger(nil)
+
+func mustNotError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Keeps every message logged to it, for tests that check what the
+// package had to say.
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) logged(substring string) bool {
+	for _, message := range l.messages {
+		if strings.Contains(message, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+// Makes a directory for the test's files, removed by the returned func.
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "docker-machine-helper")
+	mustNotError(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func writeFile(t *testing.T, path string, contents []byte) {
+	t.Helper()
+	mustNotError(t, ioutil.WriteFile(path, contents, 0600))
+}
+
+// A CA along with a server cert and a client cert it signed, the same
+// arrangement docker-machine creates for every machine.
+type testPKI struct {
+	caCert        *x509.Certificate
+	caKey         *ecdsa.PrivateKey
+	caPEM         []byte
+	clientCertPEM []byte
+	clientKeyPEM  []byte
+	serverCert    tls.Certificate
+}
+
+// Issues the server cert for the given names and addresses, by default
+// 127.0.0.1 and localhost so that httptest servers match it.
+func newTestPKI(t *testing.T, serverHosts ...string) *testPKI {
+	t.Helper()
+	if len(serverHosts) == 0 {
+		serverHosts = []string{"127.0.0.1", "localhost"}
+	}
+	caKey := newTestKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	mustNotError(t, err)
+	caCert, err := x509.ParseCertificate(der)
+	mustNotError(t, err)
+	p := &testPKI{caCert: caCert, caKey: caKey, caPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+	p.clientCertPEM, p.clientKeyPEM = p.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, time.Now().Add(24*time.Hour))
+	serverTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: serverHosts[0]},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range serverHosts {
+		if ip := net.ParseIP(host); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, host)
+		}
+	}
+	serverCertPEM, serverKeyPEM := p.issue(t, serverTemplate, time.Now().Add(24*time.Hour))
+	p.serverCert, err = tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+	mustNotError(t, err)
+	return p
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	mustNotError(t, err)
+	return key
+}
+
+var testSerial int64 = 1
+
+// Signs the template with the CA, returning the cert and a new key for
+// it as PEM.
+func (p *testPKI) issue(t *testing.T, template *x509.Certificate, notAfter time.Time) ([]byte, []byte) {
+	t.Helper()
+	key := newTestKey(t)
+	testSerial++
+	template.SerialNumber = big.NewInt(testSerial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = notAfter
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, p.caCert, &key.PublicKey, p.caKey)
+	mustNotError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	mustNotError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// Writes ca.pem, cert.pem and key.pem to the directory, as they'd be
+// in a machine's store.
+func (p *testPKI) writeCerts(t *testing.T, dir string) {
+	t.Helper()
+	writeFile(t, filepath.Join(dir, "ca.pem"), p.caPEM)
+	writeFile(t, filepath.Join(dir, "cert.pem"), p.clientCertPEM)
+	writeFile(t, filepath.Join(dir, "key.pem"), p.clientKeyPEM)
+}
+
+// Starts a server that, like the docker daemon, only talks to clients
+// with a cert from the CA.
+func (p *testPKI) tlsServer(handler http.Handler) *httptest.Server {
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(p.caCert)
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{p.serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	return server
+}
+
+// The config docker-machine would report for a machine whose certs
+// writeCerts put in the directory and whose daemon is the server.
+func tlsMachineConfig(dir string, server *httptest.Server) DockerMachineConfig {
+	return DockerMachineConfig{
+		URL:       "tcp://" + server.Listener.Addr().String(),
+		TLSVerify: true,
+		TLSCaCert: filepath.Join(dir, "ca.pem"),
+		TLSCert:   filepath.Join(dir, "cert.pem"),
+		TLSKey:    filepath.Join(dir, "key.pem"),
+	}
+}
+
+// Answers /version and /_ping the way a daemon speaking the API version
+// would.
+func versionHandler(apiVersion string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_ping":
+			w.Header().Set("API-Version", apiVersion)
+			fmt.Fprint(w, "OK")
+		case "/version":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"ApiVersion": %q, "Version": "19.03.12"}`, apiVersion)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func containsString(items []string, item string) bool {
+	for _, candidate := range items {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the variable until the returned func restores it.
+func setenv(key, value string) func() {
+	old, existed := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if existed {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// Answers `docker-machine config` with the given output, and fails any
+// other subcommand as docker-machine would for one it can't carry out.
+func configRunner(items ...string) cannedRunner {
+	return func(args []string) ([]string, error) {
+		if len(args) == 0 || args[0] != "config" {
+			return nil, fmt.Errorf("exit status 1: cannot run %q here", args)
+		}
+		return items, nil
+	}
+}
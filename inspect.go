@@ -0,0 +1,50 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A config source reading the JSON `docker-machine inspect` prints
+// rather than scrubbing the flags `docker-machine config` prints. Older
+// versions whose inspect output can't be used fall back onto
+// `docker-machine config`.
+func (o *options) configFromInspectCommand(ctx context.Context, machineName string) (DockerMachineConfig, error) {
+	config, err := o.inspectMachine(ctx, machineName)
+	if err != nil {
+		if errors.Is(err, ErrDockerMachineNotInstalled) || errors.Is(err, ErrNoActiveMachine) {
+			return DockerMachineConfig{}, err
+		}
+		o.logger.Printf("Could not inspect %s, asking docker-machine config: %s", describeMachine(machineName), err)
+		// Inspecting again for the driver would only fail the same way
+		return o.configFromConfigOutput(ctx, machineName)
+	}
+	return config, nil
+}
+
+func (o *options) inspectMachine(ctx context.Context, machineName string) (DockerMachineConfig, error) {
+	inspection, err := o.inspect(ctx, machineName)
+	if err != nil {
+		return DockerMachineConfig{}, err
+	}
+	return configFromMachineInspection(inspection)
+}
+
+func (o *options) inspect(ctx context.Context, machineName string) (machineInspection, error) {
+	items, err := o.getConfigOutputFromDockerMachine(ctx, machineName, "inspect")
+	if err != nil {
+		return machineInspection{}, err
+	}
+	return parseMachineInspection(strings.Join(items, "\n"))
+}
+
+func parseMachineInspection(output string) (machineInspection, error) {
+	inspection := machineInspection{}
+	if err := json.Unmarshal([]byte(output), &inspection); err != nil {
+		return machineInspection{}, fmt.Errorf("could not parse docker-machine inspect output: %w", err)
+	}
+	return inspection, nil
+}
@@ -0,0 +1,101 @@
+package docker_machine_helper
+
+import (
+	"errors"
+	"testing"
+)
+
+// Trimmed from what `docker-machine inspect` prints for a virtualbox
+// machine.
+const sampleInspection = `{
+    "ConfigVersion": 3,
+    "Driver": {
+        "IPAddress": "192.168.99.100",
+        "MachineName": "dev",
+        "SSHUser": "docker",
+        "SSHPort": 50022,
+        "SSHKeyPath": "/home/dev/.docker/machine/machines/dev/id_rsa",
+        "StorePath": "/home/dev/.docker/machine",
+        "CPU": 1,
+        "Memory": 1024
+    },
+    "DriverName": "virtualbox",
+    "HostOptions": {
+        "Driver": "",
+        "EngineOptions": {
+            "InstallURL": "https://get.docker.com",
+            "StorageDriver": "",
+            "TlsVerify": true
+        },
+        "AuthOptions": {
+            "CertDir": "/home/dev/.docker/machine/certs",
+            "CaCertPath": "/home/dev/.docker/machine/certs/ca.pem",
+            "ClientKeyPath": "/home/dev/.docker/machine/certs/key.pem",
+            "ClientCertPath": "/home/dev/.docker/machine/certs/cert.pem",
+            "StorePath": "/home/dev/.docker/machine/machines/dev"
+        }
+    },
+    "Name": "dev"
+}`
+
+func TestDriverFromInspection(t *testing.T) {
+	inspection, err := parseMachineInspection(sampleInspection)
+	mustNotError(t, err)
+	config, err := configFromMachineInspection(inspection)
+	mustNotError(t, err)
+	expected := DockerMachineConfig{
+		URL:       "tcp://192.168.99.100:2376",
+		TLSVerify: true,
+		TLSCaCert: "/home/dev/.docker/machine/certs/ca.pem",
+		TLSCert:   "/home/dev/.docker/machine/certs/cert.pem",
+		TLSKey:    "/home/dev/.docker/machine/certs/key.pem",
+		Driver:    "virtualbox",
+	}
+	if config != expected {
+		t.Errorf("expected %+v, got %+v", expected, config)
+	}
+}
+
+func TestInspectSource(t *testing.T) {
+	defer withCommandRunner(func(args []string) ([]string, error) {
+		if args[0] != "inspect" {
+			t.Errorf("expected only inspect to run, ran %q", args)
+		}
+		return []string{sampleInspection}, nil
+	})()
+	config, err := ResolveConfig("dev", quietLogger, WithInspectSource())
+	mustNotError(t, err)
+	if config.Driver != "virtualbox" {
+		t.Errorf("expected the driver, got %q", config.Driver)
+	}
+}
+
+func TestDriverOnDefaultPath(t *testing.T) {
+	config := configRunner("-H=tcp://192.168.99.100:2376")
+	defer withCommandRunner(func(args []string) ([]string, error) {
+		if args[0] == "inspect" {
+			return []string{"amazonec2"}, nil
+		}
+		return config(args)
+	})()
+	resolved, err := ResolveConfig("dev", quietLogger)
+	mustNotError(t, err)
+	if resolved.Driver != "amazonec2" {
+		t.Errorf("expected the driver from inspect, got %q", resolved.Driver)
+	}
+}
+
+func TestDriverIsBestEffort(t *testing.T) {
+	config := configRunner("-H=tcp://192.168.99.100:2376")
+	defer withCommandRunner(func(args []string) ([]string, error) {
+		if args[0] == "inspect" {
+			return nil, errors.New("exit status 1: inspect is not supported")
+		}
+		return config(args)
+	})()
+	resolved, err := ResolveConfig("dev", quietLogger)
+	mustNotError(t, err)
+	if resolved.Driver != "" || resolved.URL != "tcp://192.168.99.100:2376" {
+		t.Errorf("expected the config without a driver, got %+v", resolved)
+	}
+}
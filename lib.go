@@ -2,17 +2,30 @@ package docker_machine_helper
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/sockets"
+	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"os/exec"
-	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // A function that will either return a
@@ -21,43 +34,555 @@ type DockerClientSupplier func() (*client.Client, error)
 // Attempts to contact `docker-machine` and if it can, it will use it.
 // If it can't get through to docker machine (for instance, if you have
 // an actual docker installation available) it will fall back onto
-// the client.NewEnvClient
-func GetDockerClientEnvFallback() (*client.Client, error) {
-	return GetDockerClient(client.NewEnvClient)
+// a client configured from the environment. When DOCKER_HOST is set the
+// certs in DOCKER_CERT_PATH are loaded just as a machine's would be,
+// the daemon only being verified if DOCKER_TLS_VERIFY is set, and
+// otherwise the client is configured as client.FromEnv does. It's
+// GetDockerClientOrElse(EnvClientSupplier) apart from that TLS handling.
+func GetDockerClientEnvFallback(opts ...Option) (*client.Client, error) {
+	return GetDockerClient(nil, append([]Option{withEnvFallback()}, opts...)...)
+}
+
+// A client configured from DOCKER_HOST, DOCKER_API_VERSION,
+// DOCKER_CERT_PATH and DOCKER_TLS_VERIFY, exactly as client.FromEnv
+// configures it. GetDockerClientEnvFallback only uses it when
+// DOCKER_HOST is unset and the default socket exists; with DOCKER_HOST
+// set it builds the client with its own options instead. Pass it
+// wherever a DockerClientSupplier is wanted.
+func EnvClientSupplier() (*client.Client, error) {
+	return client.NewClientWithOpts(client.FromEnv)
+}
+
+// A supplier for a daemon listening on the unix socket at the given
+// path, such as /var/run/docker.sock, for deployments where the
+// fallback shouldn't depend on DOCKER_HOST. The API version is
+// negotiated on the client's first request.
+func UnixSocketSupplier(path string) DockerClientSupplier {
+	return func() (*client.Client, error) {
+		return client.NewClientWithOpts(
+			client.WithHost("unix://"+path),
+			client.WithAPIVersionNegotiation(),
+		)
+	}
 }
 
 // Attempts to contact `docker-machine` and if it can, it will use it.
 // If it can't get through to docker machine (for instance, if you have
 // an actual docker installation available) it will fall back onto
 // the your dockerClientSupplier.
-func GetDockerClient(dockerClientSupplier DockerClientSupplier) (*client.Client, error) {
-	dockerMachineConfig, err := getDockerMachineConfig()
-	// The call to docker-machine failed, which means we can fall back
-	// to our alternate client supplier
+func GetDockerClient(dockerClientSupplier DockerClientSupplier, opts ...Option) (*client.Client, error) {
+	return GetDockerClientContext(context.Background(), dockerClientSupplier, opts...)
+}
+
+// GetDockerClient by a name that says what the supplier is for: the
+// client to use, for this call, when `docker-machine` can't be.
+func GetDockerClientOrElse(dockerClientSupplier DockerClientSupplier, opts ...Option) (*client.Client, error) {
+	return GetDockerClient(dockerClientSupplier, opts...)
+}
+
+// The same as GetDockerClient, but the given context governs both the
+// `docker-machine` subprocess and the request made to determine the API
+// version. Cancelling the context aborts whichever one is in flight.
+func GetDockerClientContext(ctx context.Context, dockerClientSupplier DockerClientSupplier, opts ...Option) (*client.Client, error) {
+	opts = append([]Option{WithFallbackSupplier(dockerClientSupplier)}, opts...)
+	return NewClientFactory(opts...).Client(ctx)
+}
+
+// The same as GetDockerClientContext, but pings the daemon before
+// returning so that an unreachable daemon is reported up front, as
+// ErrDaemonUnreachable, rather than by the first real API call.
+func GetDockerClientWithPing(ctx context.Context, dockerClientSupplier DockerClientSupplier, opts ...Option) (*client.Client, error) {
+	dockerClient, err := GetDockerClientContext(ctx, dockerClientSupplier, opts...)
 	if err != nil {
-		return dockerClientSupplier()
+		return nil, err
+	}
+	if err := pingClient(ctx, dockerClient); err != nil {
+		return nil, err
+	}
+	return dockerClient, nil
+}
+
+// The same as GetDockerClientContext, but runs verify against the client
+// before returning it, for checks a ping can't make, such as a proxy
+// that lets /version through but blocks /containers/json. If verify
+// fails, the client is closed and the error returned. A nil verify
+// means PingVerifier.
+func GetDockerClientVerified(ctx context.Context, dockerClientSupplier DockerClientSupplier, verify func(*client.Client) error, opts ...Option) (*client.Client, error) {
+	if verify == nil {
+		verify = PingVerifier(ctx)
+	}
+	dockerClient, err := GetDockerClientContext(ctx, dockerClientSupplier, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(dockerClient); err != nil {
+		dockerClient.Close()
+		return nil, err
+	}
+	return dockerClient, nil
+}
+
+// The verification GetDockerClientWithPing makes, for
+// GetDockerClientVerified: the daemon must answer a ping, or the error
+// is ErrDaemonUnreachable.
+func PingVerifier(ctx context.Context) func(*client.Client) error {
+	return func(dockerClient *client.Client) error {
+		if _, err := dockerClient.Ping(ctx); err != nil {
+			return &causedError{kind: ErrDaemonUnreachable, cause: err}
+		}
+		return nil
 	}
-	tlsConfig, err := loadDockerMachineCerts(dockerMachineConfig.tlsCaCert, dockerMachineConfig.tlsCert, dockerMachineConfig.tlsKey)
+}
+
+// The same as GetDockerClient, but also returns the config the client
+// was built from, saving a second `docker-machine` call to find out.
+// If the supplier was used instead, the config's UsedFallback is set.
+func GetDockerClientWithConfig(dockerClientSupplier DockerClientSupplier, opts ...Option) (*client.Client, DockerMachineConfig, error) {
+	opts = append([]Option{WithFallbackSupplier(dockerClientSupplier)}, opts...)
+	return NewClientFactory(opts...).ClientWithConfig(context.Background())
+}
+
+// The same as GetDockerClient, but also reports whether the client came
+// from the supplier rather than `docker-machine`, so callers can tell
+// users which daemon they're actually talking to.
+func GetDockerClientEx(dockerClientSupplier DockerClientSupplier, opts ...Option) (*client.Client, bool, error) {
+	dockerClient, config, err := GetDockerClientWithConfig(dockerClientSupplier, opts...)
+	return dockerClient, config.UsedFallback, err
+}
+
+// The same as GetDockerClient, but targets the named machine rather
+// than whichever one `docker-machine` considers active. An empty name
+// behaves exactly like GetDockerClient.
+func GetDockerClientForMachine(machineName string, dockerClientSupplier DockerClientSupplier, opts ...Option) (*client.Client, error) {
+	opts = append([]Option{WithMachineName(machineName), WithFallbackSupplier(dockerClientSupplier)}, opts...)
+	return NewClientFactory(opts...).Client(context.Background())
+}
+
+// Connects through `docker-machine` only. Unlike GetDockerClient there
+// is no fallback: if `docker-machine` can't be used the reason is
+// returned, and can be checked with errors.Is against
+// ErrDockerMachineNotInstalled or ErrDockerMachineConfigFailed.
+func GetDockerMachineClient(ctx context.Context, machineName string, opts ...Option) (*client.Client, error) {
+	opts = append([]Option{WithMachineName(machineName)}, opts...)
+	return NewClientFactory(opts...).Client(ctx)
+}
+
+// The same as GetDockerMachineClient without a context. Failing to get
+// the config or load the certs is returned immediately, rather than
+// deferred to the first API call against a fallback client.
+func GetDockerClientStrict(machineName string, opts ...Option) (*client.Client, error) {
+	return GetDockerMachineClient(context.Background(), machineName, opts...)
+}
+
+// Builds a client from a config obtained elsewhere, such as from
+// ResolveConfig or another tool, loading its certs and asking the
+// daemon for its API version as usual but without running
+// `docker-machine`.
+func NewClientFromConfig(dockerMachineConfig DockerMachineConfig, opts ...Option) (*client.Client, error) {
+	return newOptions(opts).newClientFromConfig(context.Background(), dockerMachineConfig.MachineName, dockerMachineConfig)
+}
+
+func (o *options) newClientFromConfig(ctx context.Context, machineName string, dockerMachineConfig DockerMachineConfig) (*client.Client, error) {
+	tlsConfig, err := o.loadTLSConfig(machineName, dockerMachineConfig)
 	if err != nil {
 		return nil, err
 	}
-	transport := &http.Transport{TLSClientConfig: tlsConfig}
-	httpClient := &http.Client{Transport: transport}
-	apiVersion, err := determineApiVersion(dockerMachineConfig.url, httpClient)
+	return o.newClientWithTLSConfig(ctx, machineName, dockerMachineConfig, tlsConfig)
+}
+
+// Resolves the named machine, an empty name meaning the active one, and
+// returns the mutual TLS config needed to talk to it, for callers who
+// want to build their own transport and client. The config is nil for
+// machines that don't use TLS.
+func BuildTLSConfig(machineName string, opts ...Option) (*tls.Config, error) {
+	o := newOptions(opts)
+	dockerMachineConfig, err := o.getDockerMachineConfig(context.Background(), machineName)
 	if err != nil {
 		return nil, err
 	}
-	return client.NewClient(dockerMachineConfig.url, apiVersion, httpClient, map[string]string{})
+	return o.loadTLSConfig(machineName, dockerMachineConfig)
+}
+
+// Returns a nil config, meaning plain http, for machines that don't
+// report tlsverify, whatever cert paths they report alongside. A
+// PKCS#12 bundle doesn't change that, as there's no CA cert to go with
+// it.
+func (o *options) loadTLSConfig(machineName string, dockerMachineConfig DockerMachineConfig) (_ *tls.Config, err error) {
+	if o.certBytes == nil && !usesTLS(dockerMachineConfig) {
+		return nil, nil
+	}
+	defer o.observeStage(StageCerts, time.Now(), &err)
+	if dockerMachineConfig.skipVerify && !o.insecureSkipVerify {
+		skipping := *o
+		skipping.insecureSkipVerify = true
+		o = &skipping
+	}
+	if o.certBytes != nil {
+		tlsConfig, err := o.buildTLSConfig("the supplied CA cert", "the supplied client cert", o.certBytes.caCert, o.certBytes.cert, o.certBytes.key)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the supplied certs: %w", err)
+		}
+		return tlsConfig, nil
+	}
+	if o.pkcs12 != nil {
+		tlsConfig, err := o.loadPKCS12Certs(dockerMachineConfig.TLSCaCert)
+		if err != nil {
+			return nil, fmt.Errorf("could not load certs for %s: %w", describeMachine(machineName), err)
+		}
+		return tlsConfig, nil
+	}
+	tlsConfig, err := o.loadDockerMachineCerts(dockerMachineConfig.TLSCaCert, dockerMachineConfig.TLSCert, dockerMachineConfig.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not load certs for %s: %w", describeMachine(machineName), err)
+	}
+	return tlsConfig, nil
+}
+
+func (o *options) newClientWithTLSConfig(ctx context.Context, machineName string, dockerMachineConfig DockerMachineConfig, tlsConfig *tls.Config) (*client.Client, error) {
+	if o.preflightDNS {
+		if err := resolveDockerHost(ctx, dockerMachineConfig.URL); err != nil {
+			return nil, fmt.Errorf("could not reach %s: %w", describeMachine(machineName), err)
+		}
+	}
+	httpClient, err := o.newHTTPClient(dockerMachineConfig.URL, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach %s: %w", describeMachine(machineName), err)
+	}
+	useTLS := transportUsesTLS(httpClient)
+	// The docker client parses the host with net/url too
+	host := escapeZone(dockerMachineConfig.URL)
+	// Connections opened by the probe would otherwise linger in a pool
+	// nobody holds any more. A caller's own client is theirs to manage.
+	closeOnError := func() {
+		if o.httpClient == nil || o.ownsHTTPClient {
+			httpClient.CloseIdleConnections()
+		}
+	}
+	if o.clientNegotiation && o.pinnedApiVersion() == "" {
+		dockerClient, err := o.newNegotiatedClient(ctx, host, httpClient, useTLS)
+		if err != nil {
+			closeOnError()
+			return nil, fmt.Errorf("could not reach %s: %w", describeMachine(machineName), err)
+		}
+		return dockerClient, nil
+	}
+	apiVersion, err := o.resolveApiVersion(ctx, host, httpClient, useTLS)
+	if err != nil {
+		closeOnError()
+		return nil, fmt.Errorf("could not reach %s: %w", describeMachine(machineName), err)
+	}
+	start := time.Now()
+	dockerClient, err := client.NewClientWithOpts(
+		client.WithHost(host),
+		client.WithScheme(clientScheme(useTLS)),
+		client.WithVersion(apiVersion),
+		client.WithHTTPClient(httpClient),
+		client.WithHTTPHeaders(o.httpHeaders),
+	)
+	o.observeStage(StageClient, start, &err)
+	if err != nil {
+		closeOnError()
+		return nil, err
+	}
+	return dockerClient, nil
+}
+
+// Builds the client at the library's own version and lets it negotiate
+// down from there. NegotiateAPIVersion swallows a failed ping and
+// settles on the oldest version, so the ping is made here instead and
+// its error returned before negotiating from its answer.
+func (o *options) newNegotiatedClient(ctx context.Context, host string, httpClient *http.Client, useTLS bool) (_ *client.Client, err error) {
+	start := time.Now()
+	dockerClient, err := client.NewClientWithOpts(
+		client.WithHost(host),
+		client.WithScheme(clientScheme(useTLS)),
+		client.WithHTTPClient(httpClient),
+		client.WithHTTPHeaders(o.httpHeaders),
+	)
+	o.observeStage(StageClient, start, &err)
+	if err != nil {
+		return nil, err
+	}
+	var ping types.Ping
+	start = time.Now()
+	err = o.retry(ctx, func() (err error) {
+		ping, err = o.pingForNegotiation(ctx, dockerClient)
+		return err
+	})
+	o.observeStage(StageProbe, start, &err)
+	if err != nil {
+		return nil, err
+	}
+	dockerClient.NegotiateAPIVersionPing(ping)
+	negotiated := dockerClient.ClientVersion()
+	apiVersion, err := o.clampApiVersion(negotiated)
+	if err != nil {
+		return nil, err
+	}
+	if apiVersion == negotiated {
+		return dockerClient, nil
+	}
+	// A negotiated client won't be moved off the version it settled on,
+	// so the clamped version needs a client of its own
+	return client.NewClientWithOpts(
+		client.WithHost(host),
+		client.WithScheme(clientScheme(useTLS)),
+		client.WithVersion(apiVersion),
+		client.WithHTTPClient(httpClient),
+		client.WithHTTPHeaders(o.httpHeaders),
+	)
+}
+
+// Each attempt gets the full probe timeout, as with probeApiVersion.
+func (o *options) pingForNegotiation(ctx context.Context, dockerClient *client.Client) (types.Ping, error) {
+	if o.probeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.probeTimeout)
+		defer cancel()
+	}
+	ping, err := dockerClient.Ping(ctx)
+	return ping, tlsHandshakeError(err)
+}
+
+// Uses the caller's client if one was given, filling in the machine's
+// TLS config only when its transport doesn't already carry one. The
+// caller's client and transport are copied rather than modified.
+func (o *options) newHTTPClient(host string, tlsConfig *tls.Config) (*http.Client, error) {
+	if o.httpClient != nil {
+		httpClient := *o.httpClient
+		if httpClient.Transport == nil {
+			httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig, Proxy: o.proxy}
+			return &httpClient, nil
+		}
+		transport, ok := httpClient.Transport.(*http.Transport)
+		if !ok {
+			return nil, fmt.Errorf("unsupported transport %T, the docker client needs an *http.Transport", httpClient.Transport)
+		}
+		if transport.TLSClientConfig == nil {
+			transport = transport.Clone()
+			transport.TLSClientConfig = tlsConfig
+			httpClient.Transport = transport
+		}
+		return &httpClient, nil
+	}
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: o.maxIdleConnsPerHost,
+		IdleConnTimeout:     o.idleConnTimeout,
+	}
+	// Sockets and named pipes need a dialer that knows how to reach them,
+	// tcp hosts are dialed as-is, through the proxy if there is one
+	if hostURL, err := client.ParseHostURL(host); err == nil && isSocketProto(hostURL.Scheme) {
+		if err := sockets.ConfigureTransport(transport, hostURL.Scheme, hostURL.Host); err != nil {
+			return nil, err
+		}
+	} else {
+		transport.Proxy = o.proxy
+	}
+	return &http.Client{Transport: transport}, nil
 }
 
-func determineApiVersion(host string, client *http.Client) (string, error) {
-	regex := regexp.MustCompile("^tcp")
-	host = regex.ReplaceAllString(host, "https")
-	response, err := client.Get(host + "/version")
+// A pinned version is used as-is. Otherwise the daemon is asked, and
+// its answer capped if negotiation was requested.
+func (o *options) resolveApiVersion(ctx context.Context, host string, httpClient *http.Client, useTLS bool) (string, error) {
+	if apiVersion := o.pinnedApiVersion(); apiVersion != "" {
+		return apiVersion, nil
+	}
+	var apiVersion string
+	start := time.Now()
+	err := o.retry(ctx, func() (err error) {
+		apiVersion, err = o.probeApiVersion(ctx, host, httpClient, useTLS)
+		return err
+	})
+	o.observeStage(StageProbe, start, &err)
 	if err != nil {
 		return "", err
 	}
+	if o.negotiateAPIVersion && versions.GreaterThan(apiVersion, api.DefaultVersion) {
+		apiVersion = api.DefaultVersion
+	}
+	return o.clampApiVersion(apiVersion)
+}
+
+// The version given to WithAPIVersion, or else DOCKER_API_VERSION, as
+// the docker client itself honours it. Empty means ask the daemon.
+func (o *options) pinnedApiVersion() string {
+	if o.apiVersion != "" {
+		return o.apiVersion
+	}
+	return os.Getenv("DOCKER_API_VERSION")
+}
+
+// Holds the version within WithMinAPIVersion and WithMaxAPIVersion,
+// moving it to the nearer bound, or failing with ErrAPIVersionOutOfRange
+// if StrictAPIVersionRange was asked for.
+func (o *options) clampApiVersion(apiVersion string) (string, error) {
+	bound := ""
+	switch {
+	case o.minAPIVersion != "" && versions.LessThan(apiVersion, o.minAPIVersion):
+		bound = o.minAPIVersion
+	case o.maxAPIVersion != "" && versions.GreaterThan(apiVersion, o.maxAPIVersion):
+		bound = o.maxAPIVersion
+	default:
+		return apiVersion, nil
+	}
+	if o.strictAPIVersionRange {
+		return "", fmt.Errorf("%w: daemon speaks %s, wanted %s to %s", ErrAPIVersionOutOfRange, apiVersion, describeBound(o.minAPIVersion), describeBound(o.maxAPIVersion))
+	}
+	return bound, nil
+}
+
+func describeBound(version string) string {
+	if version == "" {
+		return "any"
+	}
+	return version
+}
+
+// Each attempt gets the full probe timeout.
+func (o *options) probeApiVersion(ctx context.Context, host string, httpClient *http.Client, useTLS bool) (string, error) {
+	if o.probeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.probeTimeout)
+		defer cancel()
+	}
+	return determineApiVersion(ctx, host, o.versionPath, useTLS, o.httpHeaders, httpClient, o.logger)
+}
+
+// Fails fast with ErrHostUnresolvable when the host's name doesn't
+// resolve, as happens with a stale VM, rather than have the probe spend
+// its timeout finding out. Sockets and IP addresses need no lookup.
+func resolveDockerHost(ctx context.Context, host string) error {
+	hostURL, err := client.ParseHostURL(host)
+	if err != nil || isSocketProto(hostURL.Scheme) {
+		return nil
+	}
+	hostname := hostURL.Host
+	if name, _, err := net.SplitHostPort(hostURL.Host); err == nil {
+		hostname = name
+	}
+	// An IPv6 zone, escaped or not, is no part of the address
+	if zone := strings.Index(hostname, "%"); zone >= 0 {
+		hostname = hostname[:zone]
+	}
+	if hostname == "" || net.ParseIP(hostname) != nil {
+		return nil
+	}
+	if _, err := net.DefaultResolver.LookupHost(ctx, hostname); err != nil {
+		return &causedError{kind: ErrHostUnresolvable, cause: err}
+	}
+	return nil
+}
+
+func isSocketProto(proto string) bool {
+	return proto == "unix" || proto == "npipe"
+}
+
+// Cert paths alone don't count: a machine with tlsverify off is spoken
+// to over plain http even if its certs are lying around.
+func usesTLS(dockerMachineConfig DockerMachineConfig) bool {
+	return dockerMachineConfig.TLSVerify
+}
+
+// Whether requests through the client will be encrypted, judged the
+// same way the docker client judges it: by the transport's TLS config.
+// It has to be asked before the first request, as net/http fills in an
+// empty TLS config while setting up HTTP/2 for a transport without one.
+func transportUsesTLS(httpClient *http.Client) bool {
+	transport, ok := httpClient.Transport.(*http.Transport)
+	return ok && transport.TLSClientConfig != nil
+}
+
+// The scheme is given to the docker client outright, for the same
+// reason, rather than left for it to judge from the transport.
+func clientScheme(useTLS bool) string {
+	if useTLS {
+		return "https"
+	}
+	return "http"
+}
+
+// Turns the docker host into the URL to ask for the version. A tcp host
+// becomes https, or http without TLS, while http and https hosts are
+// left as they are. The host's own path, if any, is kept as a prefix.
+// Going through net/url keeps IPv6 literals bracketed, with their port
+// and any zone, as in https://[fe80::1%25en0]:2376/version.
+func probeURL(host, versionPath string, useTLS bool) (string, error) {
+	host = escapeZone(host)
+	if hostURL, err := client.ParseHostURL(host); err == nil && isSocketProto(hostURL.Scheme) {
+		// The transport dials the socket itself, so the URL only needs
+		// to be well-formed, the same placeholder the docker cli uses
+		return "http://docker" + versionPath, nil
+	}
+	hostURL, err := url.Parse(host)
+	if err != nil {
+		return "", fmt.Errorf("invalid docker host %q: %w", host, err)
+	}
+	switch hostURL.Scheme {
+	case "tcp":
+		hostURL.Scheme = "http"
+		if useTLS {
+			hostURL.Scheme = "https"
+		}
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("unsupported scheme %q in docker host %q", hostURL.Scheme, host)
+	}
+	if hostURL.Host == "" {
+		return "", fmt.Errorf("no address in docker host %q", host)
+	}
+	hostURL.Path = strings.TrimSuffix(hostURL.Path, "/") + versionPath
+	return hostURL.String(), nil
+}
+
+// net/url only takes an IPv6 zone escaped as %25, the way RFC 6874 has
+// it, whereas docker hosts write zones as net.Dial takes them, as in
+// tcp://[fe80::1%en0]:2376. Hosts without a zone, or with an escaped
+// one, come back as they are.
+func escapeZone(host string) string {
+	start, end := strings.Index(host, "["), strings.Index(host, "]")
+	if start < 0 || end < start {
+		return host
+	}
+	zone := strings.Index(host[start:end], "%")
+	if zone < 0 || strings.HasPrefix(host[start+zone:end], "%25") {
+		return host
+	}
+	zone += start
+	return host[:zone] + "%25" + host[zone+1:]
+}
+
+func determineApiVersion(ctx context.Context, host, versionPath string, useTLS bool, headers map[string]string, httpClient *http.Client, logger Logger) (string, error) {
+	probe, err := probeURL(host, versionPath, useTLS)
+	if err != nil {
+		return "", err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, probe, nil)
+	if err != nil {
+		return "", err
+	}
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	// A redirect, say to a proxy's login page, is reported rather than
+	// followed, whatever the client would otherwise do with it
+	probeClient := *httpClient
+	probeClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	response, err := probeClient.Do(request)
+	if err != nil {
+		return "", tlsHandshakeError(err)
+	}
 	defer response.Body.Close()
+	if isRedirect(response.StatusCode) {
+		return "", fmt.Errorf("unexpected redirect during version probe: %d %s to %q", response.StatusCode, http.StatusText(response.StatusCode), response.Header.Get("Location"))
+	}
+	// A proxy or gateway in the way answers with its own error page,
+	// which would otherwise surface as a confusing JSON error
+	if response.StatusCode != http.StatusOK {
+		return "", probeStatusError(response.StatusCode)
+	}
 	bytes, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return "", err
@@ -68,96 +593,743 @@ func determineApiVersion(host string, client *http.Client) (string, error) {
 		return "", fmt.Errorf("could not determine ApiVersion (%s): %+v", err, string(bytes))
 	}
 	if apiVersion, ok := responseBody["ApiVersion"].(string); !ok {
-		return "", fmt.Errorf("could not determine ApiVersion: %+v", responseBody)
+		return apiVersionFromEngineVersion(responseBody, logger), nil
 	} else {
 		return apiVersion, nil
 	}
 }
 
-func getDockerMachineConfig() (DockerMachineConfig, error) {
-	items, err := getOutputItemsFromDockerMachine("config")
+// The API version each engine release introduced, oldest first.
+var engineApiVersions = []struct {
+	engine string
+	api    string
+}{
+	{"1.12", "1.24"},
+	{"1.13", "1.25"},
+	{"17.03", "1.26"},
+	{"17.04", "1.27"},
+	{"17.05", "1.29"},
+	{"17.06", "1.30"},
+	{"17.07", "1.31"},
+	{"17.09", "1.32"},
+	{"17.10", "1.33"},
+	{"17.11", "1.34"},
+	{"17.12", "1.35"},
+	{"18.02", "1.36"},
+	{"18.04", "1.37"},
+	{"18.06", "1.38"},
+	{"18.09", "1.39"},
+	{"19.03", "1.40"},
+	{"20.10", "1.41"},
+	{"23.0", "1.42"},
+	{"24.0", "1.43"},
+	{"25.0", "1.44"},
+	{"26.0", "1.45"},
+	{"27.0", "1.46"},
+}
+
+// Some daemon variants and proxies leave ApiVersion out of /version, so
+// it's worked out from the engine's own Version, or its Engine
+// component's, and failing that the library's default is used.
+func apiVersionFromEngineVersion(responseBody map[string]interface{}, logger Logger) string {
+	engineVersion, _ := responseBody["Version"].(string)
+	if engineVersion == "" {
+		components, _ := responseBody["Components"].([]interface{})
+		for _, component := range components {
+			component, _ := component.(map[string]interface{})
+			if name, _ := component["Name"].(string); name == "Engine" {
+				engineVersion, _ = component["Version"].(string)
+			}
+		}
+	}
+	// Drop suffixes like -ce and +incompatible before comparing
+	release := strings.FieldsFunc(engineVersion, func(r rune) bool { return r == '-' || r == '+' })
+	apiVersion := ""
+	// Builds such as master-dockerproject-2019-01-01 or dev say nothing
+	// about their age, so only a dotted release is looked up
+	if len(release) > 0 && isDottedNumber(release[0]) {
+		// Older engines than we know of get the oldest version we know
+		apiVersion = engineApiVersions[0].api
+		for _, known := range engineApiVersions {
+			if !versions.LessThan(release[0], known.engine) {
+				apiVersion = known.api
+			}
+		}
+	}
+	if apiVersion == "" {
+		logger.Printf("No ApiVersion in the daemon's version response, and no release to work it out from, using %s: %+v", api.DefaultVersion, responseBody)
+		return api.DefaultVersion
+	}
+	logger.Printf("No ApiVersion in the daemon's version response, using %s for engine %s", apiVersion, engineVersion)
+	return apiVersion
+}
+
+// Whether the version is made of numbers and dots alone, like 19.03.12.
+func isDottedNumber(version string) bool {
+	for _, part := range strings.Split(version, ".") {
+		if part == "" {
+			return false
+		}
+		for _, r := range part {
+			if r < '0' || r > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Runs `docker-machine config` against the active machine and returns
+// what it reported, without building a client.
+func GetDockerMachineConfig(opts ...Option) (DockerMachineConfig, error) {
+	return ResolveConfig("", opts...)
+}
+
+// Works out the endpoint and cert paths that would be used for the
+// named machine, an empty name meaning the active one, without loading
+// the certs, contacting the daemon or building a client. Useful for
+// printing the plan, or checking the cert paths exist, ahead of time.
+func ResolveConfig(machineName string, opts ...Option) (DockerMachineConfig, error) {
+	config, err := newOptions(opts).getDockerMachineConfig(context.Background(), machineName)
+	if err != nil {
+		return DockerMachineConfig{}, err
+	}
+	config.MachineName = machineName
+	return config, nil
+}
+
+func isRedirect(statusCode int) bool {
+	return statusCode >= 300 && statusCode < 400
+}
+
+func probeStatusError(statusCode int) error {
+	status := fmt.Sprintf("version probe returned %d %s", statusCode, http.StatusText(statusCode))
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%s, the daemon or a proxy in front of it refused the request", status)
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Errorf("%s, a proxy could not reach the daemon", status)
+	}
+	return errors.New(status)
+}
+
+func (o *options) getDockerMachineConfig(ctx context.Context, machineName string) (_ DockerMachineConfig, err error) {
+	defer o.observeStage(StageConfig, time.Now(), &err)
+	if err := validateMachineName(machineName); err != nil {
+		return DockerMachineConfig{}, err
+	}
+	config, err := o.configSource(o, ctx, machineName)
+	if err != nil || o.enginePort == 0 {
+		return config, err
+	}
+	config.URL, err = withPort(config.URL, o.enginePort)
+	return config, err
+}
+
+// Swaps the port of a tcp, http or https host for another, keeping the
+// address. Sockets have no port and are left alone. A zone comes back
+// escaped, which the rest of the package takes as readily.
+func withPort(host string, port int) (string, error) {
+	hostURL, err := url.Parse(escapeZone(host))
+	if err != nil {
+		return "", fmt.Errorf("invalid docker host %q: %w", host, err)
+	}
+	if isSocketProto(hostURL.Scheme) {
+		return host, nil
+	}
+	if hostURL.Hostname() == "" {
+		return "", fmt.Errorf("no address in docker host %q", host)
+	}
+	hostURL.Host = net.JoinHostPort(hostURL.Hostname(), strconv.Itoa(port))
+	return hostURL.String(), nil
+}
+
+// The default config source, parsing the flags `docker-machine config`
+// would hand to the docker cli.
+func (o *options) configFromConfigCommand(ctx context.Context, machineName string) (DockerMachineConfig, error) {
+	config, err := o.configFromConfigOutput(ctx, machineName)
 	if err != nil {
 		return DockerMachineConfig{}, err
 	}
-	config := parseDockerMachineOutput(items)
+	config.Driver = o.driverOf(ctx, machineName)
 	return config, nil
 }
 
+// `docker-machine config` doesn't report the driver, so it's asked of
+// `docker-machine inspect`, once and without retrying. It's only for
+// callers' information, so failing to get it leaves it empty.
+func (o *options) driverOf(ctx context.Context, machineName string) string {
+	args, err := machineArgs(machineName, "inspect", "--format", "{{.DriverName}}")
+	if err != nil {
+		return ""
+	}
+	items, err := o.getOutputItemsFromDockerMachine(ctx, args...)
+	if err != nil || len(items) != 1 {
+		return ""
+	}
+	return strings.TrimSpace(items[0])
+}
+
+func (o *options) configFromConfigOutput(ctx context.Context, machineName string) (DockerMachineConfig, error) {
+	items, err := o.getConfigOutputFromDockerMachine(ctx, machineName, "config")
+	if err != nil {
+		return DockerMachineConfig{}, err
+	}
+	config := configFromRawConfig(parseRawDockerMachineOutput(items), o.logger)
+	if config.URL == "" {
+		return DockerMachineConfig{}, unparseableConfigError(machineName, items)
+	}
+	return resolveCertPaths(config, o.machineStoragePath()), nil
+}
+
+// Output without a host, perhaps from a docker-machine whose format has
+// changed, would otherwise surface as a baffling failure to probe "".
+// The output is kept in the error for debugging.
+func unparseableConfigError(machineName string, outputItems []string) error {
+	return fmt.Errorf("could not get config for %s: %w", describeMachine(machineName), &causedError{
+		kind:  ErrUnparseableConfig,
+		cause: fmt.Errorf("no docker host in output %q", strings.Join(outputItems, "\n")),
+	})
+}
+
+func (o *options) rawConfigFromConfigCommand(ctx context.Context, machineName string) (map[string]string, error) {
+	items, err := o.getConfigOutputFromDockerMachine(ctx, machineName, "config")
+	if err != nil {
+		return nil, err
+	}
+	return parseRawDockerMachineOutput(items), nil
+}
+
+// Returns every key and value `docker-machine config` reported for the
+// named machine, or `docker-machine env` with WithDockerMachineEnvSource,
+// for callers who need more than DockerMachineConfig holds. Flags given
+// without a value map to an empty string.
+func GetRawConfig(machineName string, opts ...Option) (map[string]string, error) {
+	o := newOptions(opts)
+	return o.rawConfigSource(o, context.Background(), machineName)
+}
+
+// Runs one of the `docker-machine` subcommands that describe a machine,
+// classifying any failure as ErrDockerMachineNotInstalled or
+// ErrDockerMachineConfigFailed.
+func (o *options) getConfigOutputFromDockerMachine(ctx context.Context, machineName string, args ...string) ([]string, error) {
+	args, err := machineArgs(machineName, args...)
+	if err != nil {
+		return nil, err
+	}
+	var items []string
+	err = o.retry(ctx, func() (err error) {
+		items, err = o.getOutputItemsFromDockerMachine(ctx, args...)
+		return err
+	})
+	if err != nil {
+		if !errors.Is(err, ErrDockerMachineNotInstalled) {
+			err = &causedError{kind: ErrDockerMachineConfigFailed, cause: err}
+			if machineName == "" && isNoActiveMachine(err) {
+				err = &causedError{kind: ErrNoActiveMachine, cause: err}
+			}
+		}
+		return nil, fmt.Errorf("could not get config for %s: %w", describeMachine(machineName), err)
+	}
+	return items, nil
+}
+
+// Names the machine in error messages, an empty name meaning whichever
+// machine `docker-machine` considers active.
+func describeMachine(machineName string) string {
+	if machineName == "" {
+		return "the active machine"
+	}
+	return fmt.Sprintf("machine %q", machineName)
+}
+
+// Where loadDockerMachineCerts gets the system roots from. On Windows,
+// some Go versions return an error here rather than a nil pool.
+var systemCertPool = x509.SystemCertPool
+
 // Important references:
 // 	https://forfuncsake.github.io/post/2017/08/trust-extra-ca-cert-in-go-app/
 // 	https://medium.com/@sirsean/mutually-authenticated-tls-from-a-go-client-92a117e605a1
-func loadDockerMachineCerts(caCertFilePath, certFilePath, keyFilePath string) (*tls.Config, error) {
-	// Append our certificate-authority cert to the system pool
-	rootCAs, _ := x509.SystemCertPool()
-	if rootCAs == nil {
-		rootCAs = x509.NewCertPool()
+func (o *options) loadDockerMachineCerts(caCertFilePath, certFilePath, keyFilePath string) (*tls.Config, error) {
+	caCertPEM, err := readCACertFiles(caCertFilePath)
+	if err != nil {
+		return nil, err
 	}
-	certs, err := ioutil.ReadFile(caCertFilePath)
+	certPEM, err := readCertFile("client cert", certFilePath)
 	if err != nil {
 		return nil, err
 	}
-	if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
-		return nil, fmt.Errorf("no certs appended, using system certs only")
+	keyPEM, err := readCertFile("client key", keyFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return o.buildTLSConfig(caCertFilePath, certFilePath, caCertPEM, certPEM, keyPEM)
+}
+
+// A chain may be given as several files separated by commas, which
+// AppendCertsFromPEM takes as one bundle. A path that exists as it is,
+// such as one under C:\Users\Doe, John, is a single file whatever its
+// commas.
+func readCACertFiles(caCertFilePath string) ([]byte, error) {
+	if _, err := os.Stat(caCertFilePath); err == nil || !strings.Contains(caCertFilePath, ",") {
+		return readCertFile("CA cert", caCertFilePath)
+	}
+	caCertPEM := []byte{}
+	for _, path := range strings.Split(caCertFilePath, ",") {
+		pem, err := readCertFile("CA cert", strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		caCertPEM = append(append(caCertPEM, pem...), '\n')
+	}
+	return caCertPEM, nil
+}
+
+// Says which of the files failed and whether it's missing or merely
+// unreadable. The cause is wrapped, so errors.Is(err, os.ErrNotExist)
+// and errors.Is(err, os.ErrPermission) still work.
+func readCertFile(role, filePath string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(filePath)
+	switch {
+	case err == nil:
+		return contents, nil
+	case errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("%s %s is missing: %w", role, filePath, err)
+	default:
+		return nil, fmt.Errorf("%s %s is unreadable: %w", role, filePath, err)
+	}
+}
+
+// Builds the mutual TLS config from PEM, however it was obtained. The
+// names only say where the CA and client cert came from in messages.
+func (o *options) buildTLSConfig(caCertName, certName string, caCertPEM, certPEM, keyPEM []byte) (*tls.Config, error) {
+	rootCAs := o.baseCertPool(caCertName)
+	for _, path := range o.additionalCAs {
+		pem, err := readCertFile("additional CA cert", path)
+		if err != nil {
+			return nil, err
+		}
+		if ok := rootCAs.AppendCertsFromPEM(pem); !ok {
+			return nil, fmt.Errorf("no certs appended from additional CA cert %s", path)
+		}
+	}
+	if ok := rootCAs.AppendCertsFromPEM(caCertPEM); !ok {
+		// An isolated pool with nothing in it would fail every handshake
+		if o.isolatedTrust {
+			return nil, fmt.Errorf("no certs appended from %s, and system certs are not trusted", caCertName)
+		}
+		if o.strictCACert {
+			return nil, fmt.Errorf("no certs appended, using system certs only")
+		}
+		o.logger.Printf("No certs appended from %s, using system certs only", caCertName)
 	}
 	// Get the actual client certificate
-	certificate, err := tls.LoadX509KeyPair(certFilePath, keyFilePath)
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
 	if err != nil {
+		return nil, fmt.Errorf("invalid client cert %s or its key: %w", certName, err)
+	}
+	if err := o.checkCertExpiry(certName, certificate); err != nil {
 		return nil, err
 	}
+	if o.insecureSkipVerify {
+		o.logger.Printf("Not verifying the daemon's certificate, the connection can be intercepted")
+	}
 	config := &tls.Config{
-		InsecureSkipVerify: false,
+		InsecureSkipVerify: o.insecureSkipVerify,
+		ServerName:         o.tlsServerName,
 		RootCAs:            rootCAs,
 		Certificates: []tls.Certificate{certificate},
 	}
+	if o.pinnedServerCert != "" {
+		pin, err := normalizePin(o.pinnedServerCert)
+		if err != nil {
+			return nil, err
+		}
+		config.VerifyPeerCertificate = verifyPinnedCert(pin)
+	}
 	return config, nil
 }
 
-func getOutputItemsFromDockerMachine(args ...string) ([]string, error) {
-	command := exec.Command("docker-machine", args...)
+// The pin may be in either case and separated by colons, as openssl
+// prints it. Anything that still isn't a SHA-256 fingerprint could never
+// match, and would fail every handshake with a bewildering mismatch.
+func normalizePin(pin string) (string, error) {
+	normalized := strings.ToLower(strings.ReplaceAll(pin, ":", ""))
+	if decoded, err := hex.DecodeString(normalized); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("pinned server cert %q is not a SHA-256 fingerprint of 64 hex characters", pin)
+	}
+	return normalized, nil
+}
+
+// Fails the handshake unless the daemon's own certificate, rather than
+// any the CA signed, has the pinned SHA-256 fingerprint, as given by
+// normalizePin.
+func verifyPinnedCert(pin string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("daemon presented no certificate to check against the pin")
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		if fingerprint := hex.EncodeToString(sum[:]); fingerprint != pin {
+			return fmt.Errorf("daemon certificate fingerprint %s does not match the pinned %s", fingerprint, pin)
+		}
+		return nil
+	}
+}
+
+// The pool the machine's CA cert is added to: the system roots, or an
+// empty pool when WithIsolatedTrust was asked for.
+func (o *options) baseCertPool(caCertName string) *x509.CertPool {
+	if o.isolatedTrust {
+		return x509.NewCertPool()
+	}
+	rootCAs, err := systemCertPool()
+	if err != nil {
+		o.logger.Printf("Could not load system certs, trusting only %s: %s", caCertName, err)
+	}
+	if err != nil || rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+	return rootCAs
+}
+
+// An expired client cert only shows up as a vague handshake failure,
+// so say so up front: a warning normally, ErrCertExpiringSoon if
+// StrictCertExpiry was asked for.
+func (o *options) checkCertExpiry(certFilePath string, certificate tls.Certificate) error {
+	if len(certificate.Certificate) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	remaining := time.Until(leaf.NotAfter)
+	if remaining > o.certExpiryWindow {
+		return nil
+	}
+	message := fmt.Sprintf("%s expires at %s", certFilePath, leaf.NotAfter.Format(time.RFC3339))
+	if remaining <= 0 {
+		message = fmt.Sprintf("%s expired at %s", certFilePath, leaf.NotAfter.Format(time.RFC3339))
+	}
+	if o.strictCertExpiry {
+		return fmt.Errorf("%w: %s", ErrCertExpiringSoon, message)
+	}
+	o.logger.Printf("Client cert %s", message)
+	return nil
+}
+
+func (o *options) getOutputItemsFromDockerMachine(ctx context.Context, args ...string) (_ []string, err error) {
+	defer o.observeStage(StageSubprocess, time.Now(), &err)
+	if o.configTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.configTimeout)
+		defer cancel()
+	}
+	items, err := commandRunner(ctx, o.subprocessEnv(), o.binaryPath, args...)
+	if isNotInstalled(err) {
+		return []string{}, &causedError{kind: ErrDockerMachineNotInstalled, cause: err}
+	}
+	return items, err
+}
+
+// The same as getOutputItemsFromDockerMachine, except that stdout and
+// stderr are copied to the writer as they come, for long subcommands
+// whose progress is worth watching.
+func (o *options) streamFromDockerMachine(ctx context.Context, output io.Writer, args ...string) (err error) {
+	defer o.observeStage(StageSubprocess, time.Now(), &err)
+	if o.configTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.configTimeout)
+		defer cancel()
+	}
+	err = commandStreamer(ctx, o.subprocessEnv(), output, o.binaryPath, args...)
+	if isNotInstalled(err) {
+		return &causedError{kind: ErrDockerMachineNotInstalled, cause: err}
+	}
+	return err
+}
+
+// Runs a subcommand whose output is of no interest beyond its progress,
+// streaming it if WithProgressOutput was asked for.
+func (o *options) runDockerMachine(ctx context.Context, args ...string) error {
+	if o.progressOutput != nil {
+		return o.streamFromDockerMachine(ctx, o.progressOutput, args...)
+	}
+	_, err := o.getOutputItemsFromDockerMachine(ctx, args...)
+	return err
+}
+
+// The variables set on every `docker-machine` subprocess on top of the
+// process's own environment. The C locale keeps its messages in
+// English, which is what the parsing and error matching expect.
+func (o *options) subprocessEnv() []string {
+	env := []string{"LANG=C", "LC_ALL=C"}
+	if o.storagePath != "" || o.rootless {
+		env = append(env, "MACHINE_STORAGE_PATH="+o.machineStoragePath())
+	}
+	return env
+}
+
+func isNotInstalled(err error) bool {
+	return errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist)
+}
+
+// How every subprocess is run. Swapping it for one that returns canned
+// output exercises the package without a real docker-machine binary.
+var commandRunner = getOutputItems
+
+// Runs the binary and returns the non-blank lines it wrote to stdout.
+// The env is added to, and overrides, the process's own environment.
+func getOutputItems(ctx context.Context, env []string, binaryPath string, args ...string) ([]string, error) {
+	command := exec.CommandContext(ctx, binaryPath, args...)
+	if len(env) > 0 {
+		command.Env = append(os.Environ(), env...)
+	}
 	output := bytes.Buffer{}
+	stderr := bytes.Buffer{}
 	command.Stdout = &output
+	command.Stderr = &stderr
 	err := command.Run()
 	if err != nil {
+		// A bare exit status says very little, whereas docker-machine
+		// explains itself on stderr, e.g. "Host does not exist: dev"
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return []string{}, fmt.Errorf("%w: %s", err, message)
+		}
 		return []string{}, err
 	}
-	return strings.Split(output.String(), "\n"), nil
+	// Drop the empty item after the final newline, and the carriage
+	// returns Windows leaves on the end of every line
+	items := []string{}
+	for _, line := range strings.Split(output.String(), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		items = append(items, line)
+	}
+	return items, nil
 }
 
-func parseDockerMachineOutput(outputItems []string) (config DockerMachineConfig) {
+// How subprocesses with streamed output are run, swappable like
+// commandRunner.
+var commandStreamer = streamOutput
+
+// Runs the binary with stdout and stderr copied to the writer as they
+// come. Stderr is also kept for the error, as in getOutputItems.
+func streamOutput(ctx context.Context, env []string, output io.Writer, binaryPath string, args ...string) error {
+	command := exec.CommandContext(ctx, binaryPath, args...)
+	if len(env) > 0 {
+		command.Env = append(os.Environ(), env...)
+	}
+	stderr := bytes.Buffer{}
+	command.Stdout = output
+	command.Stderr = io.MultiWriter(output, &stderr)
+	if err := command.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("%w: %s", err, message)
+		}
+		return err
+	}
+	return nil
+}
+
+// Flags some docker-machine versions add to their config output that
+// have no bearing on how we connect.
+var ignoredConfigKeys = map[string]bool{
+	"storage-driver": true,
+	"log-level":      true,
+	"debug":          true,
+	"D":              true,
+}
+
+// The unknown keys already logged, so each is only mentioned once.
+var reportedConfigKeys sync.Map
+
+// docker-machine writes values as Go quoted strings (%q), so a Windows
+// path such as C:\Users arrives as "C:\\Users". Unquoting properly
+// reverses every escape in one go. Only a single pair of surrounding
+// quotes is docker-machine's; anything inside them, such as the
+// brackets and colons of an IPv6 host, belongs to the value.
+func scrubValue(value string) string {
+	value = strings.TrimSpace(value)
+	quoted := len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`)
+	if quoted {
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			return unquoted
+		}
+		value = value[1 : len(value)-1]
+	}
+	// Not valid Go quoting, so undo the one escape we can be sure of
+	return strings.ReplaceAll(value, `\\`, `\`)
+}
+
+// Collects every flag in the output, whether or not we know what it
+// means. A flag given without a value maps to an empty string.
+// Flags may come one per line or, from some drivers, all on one line.
+func parseRawDockerMachineOutput(outputItems []string) map[string]string {
+	raw := map[string]string{}
 	for _, line := range outputItems {
-		scrubValue := func(value string) string {
-			value = strings.TrimLeft(value, `"`)
-			value = strings.TrimRight(value, `"`)
-			value = strings.ReplaceAll(value, `\\`, `\`)
-			return value
-		}
-		stuff := strings.SplitN(strings.TrimLeft(line, "-"), "=", 2)
-		if len(stuff) == 0 {
+		for _, flag := range splitConfigFlags(line) {
+			// Warnings and other chatter mixed into the output
+			if !strings.HasPrefix(flag, "-") {
+				continue
+			}
+			stuff := strings.SplitN(strings.TrimLeft(flag, "-"), "=", 2)
+			key := stuff[0]
+			if key == "" {
+				continue
+			}
+			raw[key] = ""
+			if len(stuff) == 2 {
+				raw[key] = scrubValue(stuff[1])
+			}
+		}
+	}
+	return raw
+}
+
+// Splits a line into its flags at whitespace outside double quotes. A
+// word that doesn't start with a dash belongs to the flag before it,
+// which keeps an unquoted value with spaces, like a path under
+// C:\Program Files, in one piece.
+func splitConfigFlags(line string) []string {
+	words := []string{}
+	word := strings.Builder{}
+	inQuotes, escaped := false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case inQuotes && r == '\\':
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && (r == ' ' || r == '\t'):
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+			continue
+		}
+		word.WriteRune(r)
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	flags := []string{}
+	for _, word := range words {
+		if len(flags) > 0 && !strings.HasPrefix(word, "-") {
+			flags[len(flags)-1] += " " + word
+			continue
+		}
+		flags = append(flags, word)
+	}
+	return flags
+}
+
+func configFromRawConfig(raw map[string]string, logger Logger) DockerMachineConfig {
+	config, unknown := configFromKnownKeys(raw, logger)
+	for key, value := range unknown {
+		// Mention a new key once rather than on every connect
+		if _, reported := reportedConfigKeys.LoadOrStore(key, true); !reported {
+			logger.Printf("Unknown config: %s=%s", key, value)
+		}
+	}
+	return config
+}
+
+// Fills in the config from the keys we know, returning the rest apart
+// from those known to be irrelevant.
+func configFromKnownKeys(raw map[string]string, logger Logger) (config DockerMachineConfig, unknown map[string]string) {
+	unknown = map[string]string{}
+	for key, value := range raw {
+		// Some are lone flags, so they're dropped before needing a value
+		if ignoredConfigKeys[key] {
+			continue
+		}
+		// Every key but tlsverify needs a value
+		if value == "" && key != "tlsverify" {
+			logger.Printf("Missing value for config: %s", key)
 			continue
 		}
-		key := stuff[0]
 		switch key {
 		case "tlsverify":
-			config.tlsVerify = true
+			// A lone flag means true, but an explicit value is honoured
+			config.TLSVerify = true
+			if verify, err := strconv.ParseBool(value); err == nil {
+				config.TLSVerify = verify
+			}
 		case "tlscacert":
-			config.tlsCaCert = scrubValue(stuff[1])
+			config.TLSCaCert = value
 		case "tlscert":
-			config.tlsCert = scrubValue(stuff[1])
+			config.TLSCert = value
 		case "tlskey":
-			config.tlsKey = scrubValue(stuff[1])
+			config.TLSKey = value
 		case "H":
-			config.url = scrubValue(stuff[1])
+			config.URL = value
 		default:
-			log.Println("Unknown config:", line)
+			unknown[key] = value
 		}
 	}
 	return
 }
 
+// Parses output captured from `docker-machine config` by the same rules
+// the package uses itself, flags one per line or all on one. Where the
+// package would log and carry on, this fails: on words that aren't
+// flags, on flags missing their value and on output without a host.
+func ParseConfig(output string) (DockerMachineConfig, error) {
+	raw := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		flags := splitConfigFlags(line)
+		if !strings.HasPrefix(flags[0], "-") {
+			return DockerMachineConfig{}, fmt.Errorf("malformed config output, expected a flag: %q", flags[0])
+		}
+		for key, value := range parseRawDockerMachineOutput([]string{line}) {
+			if value == "" && key != "tlsverify" && !ignoredConfigKeys[key] {
+				return DockerMachineConfig{}, fmt.Errorf("malformed config output, missing value for %s", key)
+			}
+			raw[key] = value
+		}
+	}
+	// Unknown keys are dropped without being marked as mentioned, so a
+	// real connection meeting them still logs them
+	config, _ := configFromKnownKeys(raw, LoggerFunc(func(string, ...interface{}) {}))
+	if config.URL == "" {
+		return DockerMachineConfig{}, fmt.Errorf("%w: no docker host given with -H", ErrUnparseableConfig)
+	}
+	return resolveCertPaths(config, machineStoragePath()), nil
+}
+
+// The connection details `docker-machine config` reports for a machine.
 type DockerMachineConfig struct {
-	url       string
-	tlsVerify bool
-	tlsCaCert string
-	tlsCert   string
-	tlsKey    string
+	URL       string
+	TLSVerify bool
+	TLSCaCert string
+	TLSCert   string
+	TLSKey    string
+	// The machine asked for, empty for the active machine.
+	MachineName string
+	// Set when `docker-machine` couldn't be used and the client came
+	// from the fallback supplier, in which case only APIVersion is also
+	// set.
+	UsedFallback bool
+	// Set by sources, such as a docker context with SkipTLSVerify, that
+	// want TLS without verifying the daemon's certificate.
+	skipVerify bool
+	// The machine's driver, such as virtualbox or amazonec2. By default
+	// it's asked of `docker-machine inspect` once the config is known,
+	// and left empty if that fails. WithInspectSource and
+	// WithStorageSource read it along with the rest. Configs taken from
+	// a docker context or DOCKER_* variables don't have it.
+	Driver string
+	// The API version the returned client speaks, for gating newer
+	// features. Only set by the functions that also return a client.
+	APIVersion string
 }
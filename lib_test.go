@@ -0,0 +1,1193 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/client"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConfigHostValues(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		url  string
+	}{
+		{`-H=tcp://192.168.99.100:2376`, "tcp://192.168.99.100:2376"},
+		{`-H="tcp://192.168.99.100:2376"`, "tcp://192.168.99.100:2376"},
+		{`-H="tcp://[fe80::a00:27ff:fe4e:66a1]:2376"`, "tcp://[fe80::a00:27ff:fe4e:66a1]:2376"},
+		{`-H=tcp://[::1]:2376`, "tcp://[::1]:2376"},
+		{`-H="tcp://host:2376/?a=b=c"`, "tcp://host:2376/?a=b=c"},
+		{`-H="tcp://\"quoted\":2376"`, `tcp://"quoted":2376`},
+	} {
+		config := configFromRawConfig(parseRawDockerMachineOutput([]string{test.line}), &recordingLogger{})
+		if config.URL != test.url {
+			t.Errorf("%s: expected %q, got %q", test.line, test.url, config.URL)
+		}
+	}
+}
+
+func TestConfigHostWithoutValue(t *testing.T) {
+	for _, line := range []string{`-H`, `-H=`, `-H=""`, `--H`} {
+		logger := &recordingLogger{}
+		config := configFromRawConfig(parseRawDockerMachineOutput([]string{line}), logger)
+		if config.URL != "" {
+			t.Errorf("%s: expected no URL, got %q", line, config.URL)
+		}
+		if !logger.logged("Missing value for config: H") {
+			t.Errorf("%s: expected the missing value to be logged, got %q", line, logger.messages)
+		}
+	}
+}
+
+func TestMalformedConfigLines(t *testing.T) {
+	// None of these may panic, and the good lines around them still count
+	items := []string{
+		"",
+		"   ",
+		"-",
+		"--",
+		"=",
+		"-=value",
+		`"`,
+		`-tlscert="unterminated`,
+		"WARNING: the machine is running an old version",
+		`-H="tcp://192.168.99.100:2376"`,
+	}
+	config := configFromRawConfig(parseRawDockerMachineOutput(items), &recordingLogger{})
+	if config.URL != "tcp://192.168.99.100:2376" {
+		t.Errorf("expected the host to survive, got %q", config.URL)
+	}
+}
+
+func TestTLSVerifyValues(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		verify bool
+	}{
+		{"--tlsverify", true},
+		{"--tlsverify=true", true},
+		{"--tlsverify=1", true},
+		{"--tlsverify=false", false},
+		{`--tlsverify="false"`, false},
+		{"--tlsverify=0", false},
+		{"--tlsverify=unclear", true},
+	} {
+		config := configFromRawConfig(parseRawDockerMachineOutput([]string{test.line}), &recordingLogger{})
+		if config.TLSVerify != test.verify {
+			t.Errorf("%s: expected TLSVerify %t", test.line, test.verify)
+		}
+	}
+}
+
+func TestSystemCertPoolError(t *testing.T) {
+	defer func(old func() (*x509.CertPool, error)) { systemCertPool = old }(systemCertPool)
+	systemCertPool = func() (*x509.CertPool, error) {
+		return nil, errors.New("crypto/x509: system root pool is not available on Windows")
+	}
+	pki := newTestPKI(t)
+	logger := &recordingLogger{}
+	tlsConfig, err := newOptions([]Option{WithLogger(logger)}).buildTLSConfig("ca.pem", "cert.pem", pki.caPEM, pki.clientCertPEM, pki.clientKeyPEM)
+	mustNotError(t, err)
+	if subjects := tlsConfig.RootCAs.Subjects(); len(subjects) != 1 {
+		t.Errorf("expected only the machine's CA to be trusted, got %d certs", len(subjects))
+	}
+	if !logger.logged("Could not load system certs, trusting only ca.pem") {
+		t.Errorf("expected the failure to be logged, got %q", logger.messages)
+	}
+}
+
+func TestNilSystemCertPool(t *testing.T) {
+	defer func(old func() (*x509.CertPool, error)) { systemCertPool = old }(systemCertPool)
+	systemCertPool = func() (*x509.CertPool, error) { return nil, nil }
+	pki := newTestPKI(t)
+	tlsConfig, err := newOptions([]Option{quietLogger}).buildTLSConfig("ca.pem", "cert.pem", pki.caPEM, pki.clientCertPEM, pki.clientKeyPEM)
+	mustNotError(t, err)
+	if subjects := tlsConfig.RootCAs.Subjects(); len(subjects) != 1 {
+		t.Errorf("expected only the machine's CA to be trusted, got %d certs", len(subjects))
+	}
+}
+
+func TestScrubValue(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		scrubbed string
+	}{
+		{`"C:\\Users\\dev\\.docker\\machine\\certs\\ca.pem"`, `C:\Users\dev\.docker\machine\certs\ca.pem`},
+		{`C:\\Users\\dev\\ca.pem`, `C:\Users\dev\ca.pem`},
+		{`"C:\\Program Files\\Docker\\ca.pem"`, `C:\Program Files\Docker\ca.pem`},
+		{`"\\\\server\\share\\ca.pem"`, `\\server\share\ca.pem`},
+		{`"/Users/dev/.docker/machine/certs/ca.pem"`, "/Users/dev/.docker/machine/certs/ca.pem"},
+		{`/home/dev/ca.pem`, "/home/dev/ca.pem"},
+		{`"/home/dev/my certs/ca.pem"`, "/home/dev/my certs/ca.pem"},
+		{`  "/home/dev/ca.pem"  `, "/home/dev/ca.pem"},
+		// Not valid Go quoting, so only the quotes themselves go
+		{`"C:\Users\dev\ca.pem"`, `C:\Users\dev\ca.pem`},
+		{`""`, ""},
+		{`"`, `"`},
+	} {
+		if scrubbed := scrubValue(test.value); scrubbed != test.scrubbed {
+			t.Errorf("%s: expected %q, got %q", test.value, test.scrubbed, scrubbed)
+		}
+	}
+}
+
+func TestOutputWithCRLFAndBlankLines(t *testing.T) {
+	printf, err := exec.LookPath("printf")
+	if err != nil {
+		t.Skip("no printf to stand in for docker-machine")
+	}
+	items, err := getOutputItems(context.Background(), nil, printf, `--tlsverify\r\n\r\n   \r\n-H=tcp://192.168.99.100:2376\r\n\n`)
+	mustNotError(t, err)
+	expected := []string{"--tlsverify", "-H=tcp://192.168.99.100:2376"}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("expected %q, got %q", expected, items)
+	}
+	config := configFromRawConfig(parseRawDockerMachineOutput(items), &recordingLogger{})
+	if !config.TLSVerify || config.URL != "tcp://192.168.99.100:2376" {
+		t.Errorf("expected no carriage returns in %+v", config)
+	}
+}
+
+func TestClientWithoutTLS(t *testing.T) {
+	server := httptest.NewServer(versionHandler("1.40"))
+	defer server.Close()
+	// Cert paths alone don't mean TLS, so these are never read
+	config := DockerMachineConfig{
+		URL:       "tcp://" + server.Listener.Addr().String(),
+		TLSCaCert: "/nonexistent/ca.pem",
+		TLSCert:   "/nonexistent/cert.pem",
+		TLSKey:    "/nonexistent/key.pem",
+	}
+	dockerClient, err := NewClientFromConfig(config, quietLogger)
+	mustNotError(t, err)
+	if version := dockerClient.ClientVersion(); version != "1.40" {
+		t.Errorf("expected the probed version 1.40, got %q", version)
+	}
+	if probe, err := probeURL(config.URL, "/version", false); err != nil || !strings.HasPrefix(probe, "http://") {
+		t.Errorf("expected an http probe, got %q (%v)", probe, err)
+	}
+	// The probe mustn't leave the client thinking it should speak https
+	_, err = dockerClient.Ping(context.Background())
+	mustNotError(t, err)
+	dockerClient, err = NewClientFromConfig(config, quietLogger, WithClientNegotiation())
+	mustNotError(t, err)
+	_, err = dockerClient.Ping(context.Background())
+	mustNotError(t, err)
+}
+
+func TestTLSServerNameForIPHost(t *testing.T) {
+	// The daemon's cert only names the machine, never the IP it's at
+	pki := newTestPKI(t, "dev.machine.internal")
+	server := pki.tlsServer(versionHandler("1.40"))
+	defer server.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	pki.writeCerts(t, dir)
+	config := tlsMachineConfig(dir, server)
+
+	_, err := NewClientFromConfig(config, quietLogger, WithIsolatedTrust(true))
+	if !errors.Is(err, ErrTLSHandshake) {
+		t.Errorf("expected the IP not to match the cert, got %v", err)
+	}
+	dockerClient, err := NewClientFromConfig(config, quietLogger, WithIsolatedTrust(true), WithTLSServerName("dev.machine.internal"))
+	mustNotError(t, err)
+	if version := dockerClient.ClientVersion(); version != "1.40" {
+		t.Errorf("expected 1.40, got %q", version)
+	}
+}
+
+func TestClientHostAndVersion(t *testing.T) {
+	pki := newTestPKI(t)
+	server := pki.tlsServer(versionHandler("1.39"))
+	defer server.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	pki.writeCerts(t, dir)
+	config := tlsMachineConfig(dir, server)
+
+	dockerClient, err := NewClientFromConfig(config, quietLogger)
+	mustNotError(t, err)
+	if host := dockerClient.DaemonHost(); host != config.URL {
+		t.Errorf("expected host %q, got %q", config.URL, host)
+	}
+	if version := dockerClient.ClientVersion(); version != "1.39" {
+		t.Errorf("expected the probed 1.39, got %q", version)
+	}
+	dockerClient, err = NewClientFromConfig(config, quietLogger, WithAPIVersion("1.30"))
+	mustNotError(t, err)
+	if version := dockerClient.ClientVersion(); version != "1.30" {
+		t.Errorf("expected the pinned 1.30, got %q", version)
+	}
+}
+
+func TestCertBytes(t *testing.T) {
+	pki := newTestPKI(t)
+	server := pki.tlsServer(versionHandler("1.40"))
+	defer server.Close()
+	// No cert paths at all, the PEM is all there is
+	config := DockerMachineConfig{URL: "tcp://" + server.Listener.Addr().String(), TLSVerify: true}
+	dockerClient, err := NewClientFromConfig(config, quietLogger, WithCertBytes(pki.caPEM, pki.clientCertPEM, pki.clientKeyPEM))
+	mustNotError(t, err)
+	if version := dockerClient.ClientVersion(); version != "1.40" {
+		t.Errorf("expected 1.40, got %q", version)
+	}
+
+	_, err = NewClientFromConfig(config, quietLogger, WithCertBytes(pki.caPEM, pki.clientCertPEM, []byte("not a key")))
+	if err == nil || !strings.Contains(err.Error(), "could not load the supplied certs") {
+		t.Errorf("expected the bad key to be reported, got %v", err)
+	}
+}
+
+func TestProbeURL(t *testing.T) {
+	for _, test := range []struct {
+		host   string
+		useTLS bool
+		probe  string
+	}{
+		{"tcp://192.168.99.100:2376", true, "https://192.168.99.100:2376/version"},
+		{"tcp://192.168.99.100:2375", false, "http://192.168.99.100:2375/version"},
+		{"tcp://[::1]:2376", true, "https://[::1]:2376/version"},
+		{"https://docker.example.com", false, "https://docker.example.com/version"},
+		{"http://docker.example.com:8080", true, "http://docker.example.com:8080/version"},
+		{"https://gateway.example.com/docker/", true, "https://gateway.example.com/docker/version"},
+		{"tcp://gateway.example.com:2376/docker", true, "https://gateway.example.com:2376/docker/version"},
+		{"unix:///var/run/docker.sock", false, "http://docker/version"},
+		{"npipe:////./pipe/docker_engine", false, "http://docker/version"},
+	} {
+		probe, err := probeURL(test.host, "/version", test.useTLS)
+		if err != nil {
+			t.Errorf("%s: %s", test.host, err)
+		} else if probe != test.probe {
+			t.Errorf("%s: expected %q, got %q", test.host, test.probe, probe)
+		}
+	}
+}
+
+func TestProbeURLErrors(t *testing.T) {
+	for _, host := range []string{
+		"ssh://user@host",
+		"tcp://",
+		"192.168.99.100:2376",
+		"tcp://host:port:2376%zz",
+	} {
+		if probe, err := probeURL(host, "/version", true); err == nil {
+			t.Errorf("%s: expected an error, got %q", host, probe)
+		}
+	}
+}
+
+func TestNewClientFromFixedConfig(t *testing.T) {
+	defer withCommandRunner(func(args []string) ([]string, error) {
+		t.Errorf("expected docker-machine not to run, ran with %q", args)
+		return nil, errors.New("not expected")
+	})()
+	pki := newTestPKI(t)
+	server := pki.tlsServer(versionHandler("1.41"))
+	defer server.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	pki.writeCerts(t, dir)
+	config := tlsMachineConfig(dir, server)
+	config.MachineName = "ci"
+
+	dockerClient, err := NewClientFromConfig(config, quietLogger)
+	mustNotError(t, err)
+	if dockerClient.DaemonHost() != config.URL || dockerClient.ClientVersion() != "1.41" {
+		t.Errorf("unexpected client for %s at %s", dockerClient.DaemonHost(), dockerClient.ClientVersion())
+	}
+
+	config.TLSKey = filepath.Join(dir, "missing.pem")
+	_, err = NewClientFromConfig(config, quietLogger)
+	if !errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), `machine "ci"`) {
+		t.Errorf("expected the missing key for machine ci, got %v", err)
+	}
+}
+
+func TestConfigThroughCommandRunner(t *testing.T) {
+	defer withCommandRunner(configRunner(
+		`--tlsverify`,
+		`--tlscacert="/machine/certs/ca.pem"`,
+		`--tlscert="/machine/certs/cert.pem"`,
+		`--tlskey="/machine/certs/key.pem"`,
+		`-H=tcp://192.168.99.100:2376`,
+	))()
+	config, err := ResolveConfig("dev", quietLogger)
+	mustNotError(t, err)
+	expected := DockerMachineConfig{
+		URL:         "tcp://192.168.99.100:2376",
+		TLSVerify:   true,
+		TLSCaCert:   "/machine/certs/ca.pem",
+		TLSCert:     "/machine/certs/cert.pem",
+		TLSKey:      "/machine/certs/key.pem",
+		MachineName: "dev",
+	}
+	if config != expected {
+		t.Errorf("expected %+v, got %+v", expected, config)
+	}
+}
+
+func TestConfigCommandFailure(t *testing.T) {
+	defer withCommandRunner(func([]string) ([]string, error) {
+		return nil, errors.New(`exit status 1: Host does not exist: "dev"`)
+	})()
+	_, err := ResolveConfig("dev", quietLogger)
+	if !errors.Is(err, ErrDockerMachineConfigFailed) {
+		t.Errorf("expected ErrDockerMachineConfigFailed, got %v", err)
+	}
+	if errors.Is(err, ErrNoActiveMachine) || !strings.Contains(err.Error(), "Host does not exist") {
+		t.Errorf("expected stderr in the error, got %v", err)
+	}
+}
+
+func TestNoActiveMachine(t *testing.T) {
+	for _, message := range []string{
+		"exit status 1: No active host found",
+		`exit status 1: Error checking TLS connection: no "default" machine exists`,
+	} {
+		restore := withCommandRunner(func([]string) ([]string, error) {
+			return nil, errors.New(message)
+		})
+		_, err := ResolveConfig("", quietLogger)
+		if !errors.Is(err, ErrNoActiveMachine) || !errors.Is(err, ErrDockerMachineConfigFailed) {
+			t.Errorf("%s: expected ErrNoActiveMachine, got %v", message, err)
+		}
+		// A named machine isn't the active one, whatever stderr says
+		if _, err := ResolveConfig("dev", quietLogger); errors.Is(err, ErrNoActiveMachine) {
+			t.Errorf("%s: expected a named machine not to be ErrNoActiveMachine", message)
+		}
+		restore()
+	}
+}
+
+func TestSingleAndMultiLineConfig(t *testing.T) {
+	expected := DockerMachineConfig{
+		URL:       "tcp://192.168.99.100:2376",
+		TLSVerify: true,
+		TLSCaCert: `C:\Program Files\certs\ca.pem`,
+		TLSCert:   "/machine/certs/cert.pem",
+		TLSKey:    "/machine/certs/key.pem",
+	}
+	for name, items := range map[string][]string{
+		"multi-line": {
+			`--tlsverify`,
+			`--tlscacert="C:\\Program Files\\certs\\ca.pem"`,
+			`--tlscert="/machine/certs/cert.pem"`,
+			`--tlskey="/machine/certs/key.pem"`,
+			`-H=tcp://192.168.99.100:2376`,
+		},
+		"single-line": {
+			`--tlsverify --tlscacert="C:\\Program Files\\certs\\ca.pem" --tlscert="/machine/certs/cert.pem"	--tlskey="/machine/certs/key.pem" -H=tcp://192.168.99.100:2376`,
+		},
+	} {
+		config := configFromRawConfig(parseRawDockerMachineOutput(items), &recordingLogger{})
+		if config != expected {
+			t.Errorf("%s: expected %+v, got %+v", name, expected, config)
+		}
+	}
+}
+
+func TestHTTPHeadersReachRequests(t *testing.T) {
+	mutex := sync.Mutex{}
+	tokens := map[string]string{}
+	daemon := versionHandler("1.40")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		tokens[r.URL.Path] = r.Header.Get("X-Routing-Token")
+		mutex.Unlock()
+		daemon.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	config := DockerMachineConfig{URL: "tcp://" + server.Listener.Addr().String()}
+	dockerClient, err := NewClientFromConfig(config, quietLogger, WithHTTPHeaders(map[string]string{"X-Routing-Token": "team-a"}))
+	mustNotError(t, err)
+	_, err = dockerClient.Ping(context.Background())
+	mustNotError(t, err)
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, path := range []string{"/version", "/_ping"} {
+		if tokens[path] != "team-a" {
+			t.Errorf("expected the header on %s, got %q", path, tokens[path])
+		}
+	}
+}
+
+func TestUnixSocketSupplier(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix sockets")
+	}
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	socketPath := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socketPath)
+	mustNotError(t, err)
+	server := httptest.NewUnstartedServer(versionHandler("1.40"))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	dockerClient, err := UnixSocketSupplier(socketPath)()
+	mustNotError(t, err)
+	if host := dockerClient.DaemonHost(); host != "unix://"+socketPath {
+		t.Errorf("expected unix://%s, got %q", socketPath, host)
+	}
+	_, err = dockerClient.Ping(context.Background())
+	mustNotError(t, err)
+}
+
+func TestStoragePathReachesSubprocess(t *testing.T) {
+	var env []string
+	defer func(old func(context.Context, []string, string, ...string) ([]string, error)) { commandRunner = old }(commandRunner)
+	config := configRunner("-H=tcp://192.168.99.100:2376")
+	commandRunner = func(_ context.Context, given []string, _ string, args ...string) ([]string, error) {
+		env = given
+		return config(args)
+	}
+	storagePath := filepath.FromSlash("/ci/job-42/machine")
+	_, err := ResolveConfig("dev", quietLogger, WithStoragePath(storagePath))
+	mustNotError(t, err)
+	if !containsString(env, "MACHINE_STORAGE_PATH="+storagePath) {
+		t.Errorf("expected MACHINE_STORAGE_PATH in %q", env)
+	}
+	if os.Getenv("MACHINE_STORAGE_PATH") == storagePath {
+		t.Errorf("expected the process environment to be left alone")
+	}
+
+	_, err = ResolveConfig("dev", quietLogger)
+	mustNotError(t, err)
+	for _, variable := range env {
+		if strings.HasPrefix(variable, "MACHINE_STORAGE_PATH=") {
+			t.Errorf("expected no MACHINE_STORAGE_PATH without WithStoragePath, got %q", variable)
+		}
+	}
+}
+
+func TestSubprocessEnvIsSet(t *testing.T) {
+	envBinary, err := exec.LookPath("env")
+	if err != nil {
+		t.Skip("no env to stand in for docker-machine")
+	}
+	o := newOptions([]Option{quietLogger, WithBinaryPath(envBinary), WithStoragePath("/ci/machine")})
+	items, err := o.getOutputItemsFromDockerMachine(context.Background())
+	mustNotError(t, err)
+	if !containsString(items, "MACHINE_STORAGE_PATH=/ci/machine") {
+		t.Errorf("expected MACHINE_STORAGE_PATH in the command's environment, got %q", items)
+	}
+}
+
+func TestIsolatedTrust(t *testing.T) {
+	defer func(old func() (*x509.CertPool, error)) { systemCertPool = old }(systemCertPool)
+	// Stands in for a system pool with something in it
+	other := newTestPKI(t)
+	systemCertPool = func() (*x509.CertPool, error) {
+		pool := x509.NewCertPool()
+		pool.AddCert(other.caCert)
+		return pool, nil
+	}
+	pki := newTestPKI(t)
+	tlsConfig, err := newOptions([]Option{quietLogger, WithIsolatedTrust(true)}).buildTLSConfig("ca.pem", "cert.pem", pki.caPEM, pki.clientCertPEM, pki.clientKeyPEM)
+	mustNotError(t, err)
+	subjects := tlsConfig.RootCAs.Subjects()
+	if len(subjects) != 1 || string(subjects[0]) != string(pki.caCert.RawSubject) {
+		t.Errorf("expected exactly the machine's CA to be trusted, got %d certs", len(subjects))
+	}
+
+	tlsConfig, err = newOptions([]Option{quietLogger}).buildTLSConfig("ca.pem", "cert.pem", pki.caPEM, pki.clientCertPEM, pki.clientKeyPEM)
+	mustNotError(t, err)
+	if subjects := tlsConfig.RootCAs.Subjects(); len(subjects) != 2 {
+		t.Errorf("expected the system certs and the machine's CA, got %d certs", len(subjects))
+	}
+
+	_, err = newOptions([]Option{quietLogger, WithIsolatedTrust(true)}).buildTLSConfig("ca.pem", "cert.pem", []byte("not a cert"), pki.clientCertPEM, pki.clientKeyPEM)
+	if err == nil || !strings.Contains(err.Error(), "system certs are not trusted") {
+		t.Errorf("expected an empty isolated pool to be refused, got %v", err)
+	}
+}
+
+func TestCertFileFailures(t *testing.T) {
+	pki := newTestPKI(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	pki.writeCerts(t, dir)
+	o := newOptions([]Option{quietLogger})
+	ca, cert, key := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	missing := filepath.Join(dir, "missing.pem")
+	_, err := o.loadDockerMachineCerts(ca, missing, key)
+	if !errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), "client cert "+missing+" is missing") {
+		t.Errorf("expected the client cert to be missing, got %v", err)
+	}
+	// A directory exists but can't be read as a file
+	_, err = o.loadDockerMachineCerts(ca, cert, dir)
+	if errors.Is(err, os.ErrNotExist) || err == nil || !strings.Contains(err.Error(), "client key "+dir+" is unreadable") {
+		t.Errorf("expected the client key to be unreadable, got %v", err)
+	}
+	_, err = o.loadDockerMachineCerts(missing, cert, key)
+	if !errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), "CA cert "+missing+" is missing") {
+		t.Errorf("expected the CA cert to be missing, got %v", err)
+	}
+}
+
+func TestCertFilePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("file modes can't make a file unreadable here")
+	}
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "key.pem")
+	writeFile(t, path, []byte("key"))
+	mustNotError(t, os.Chmod(path, 0))
+	_, err := readCertFile("client key", path)
+	if !errors.Is(err, os.ErrPermission) || !strings.Contains(err.Error(), "is unreadable") {
+		t.Errorf("expected a permission error, got %v", err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	mutex := sync.Mutex{}
+	proxied := []string{}
+	daemon := versionHandler("1.40")
+	// Answers for the daemon itself, as a forward proxy sees each request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		proxied = append(proxied, r.URL.String())
+		mutex.Unlock()
+		daemon.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	mustNotError(t, err)
+	// Only the proxy knows where this is
+	config := DockerMachineConfig{URL: "tcp://docker.invalid:2375"}
+	dockerClient, err := NewClientFromConfig(config, quietLogger, WithProxy(proxyURL))
+	mustNotError(t, err)
+	_, err = dockerClient.Ping(context.Background())
+	mustNotError(t, err)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(proxied) != 2 || proxied[0] != "http://docker.invalid:2375/version" || !strings.HasPrefix(proxied[1], "http://docker.invalid:2375/") {
+		t.Errorf("expected the probe and the ping to go through the proxy, got %q", proxied)
+	}
+}
+
+func TestProxySettings(t *testing.T) {
+	proxyURL, err := url.Parse("http://proxy.example.com:3128")
+	mustNotError(t, err)
+	for _, test := range []struct {
+		name    string
+		host    string
+		option  Option
+		proxied bool
+	}{
+		{"default", "tcp://192.168.99.100:2376", quietLogger, true},
+		{"explicit", "tcp://192.168.99.100:2376", WithProxy(proxyURL), true},
+		{"direct", "tcp://192.168.99.100:2376", WithProxy(nil), false},
+		{"socket", "unix:///var/run/docker.sock", WithProxy(proxyURL), false},
+	} {
+		httpClient, err := newOptions([]Option{test.option}).newHTTPClient(test.host, nil)
+		mustNotError(t, err)
+		if proxied := httpClient.Transport.(*http.Transport).Proxy != nil; proxied != test.proxied {
+			t.Errorf("%s: expected proxied %t", test.name, test.proxied)
+		}
+	}
+}
+
+func TestClampAPIVersion(t *testing.T) {
+	for _, test := range []struct {
+		daemon  string
+		opts    []Option
+		clamped string
+	}{
+		{"1.40", nil, "1.40"},
+		{"1.24", []Option{WithMinAPIVersion("1.30")}, "1.30"},
+		{"1.43", []Option{WithMaxAPIVersion("1.41")}, "1.41"},
+		{"1.35", []Option{WithMinAPIVersion("1.30"), WithMaxAPIVersion("1.41")}, "1.35"},
+		{"1.30", []Option{WithMinAPIVersion("1.30"), WithMaxAPIVersion("1.30")}, "1.30"},
+	} {
+		clamped, err := newOptions(test.opts).clampApiVersion(test.daemon)
+		mustNotError(t, err)
+		if clamped != test.clamped {
+			t.Errorf("%s: expected %s, got %s", test.daemon, test.clamped, clamped)
+		}
+	}
+}
+
+func TestStrictAPIVersionRange(t *testing.T) {
+	server := httptest.NewServer(versionHandler("1.24"))
+	defer server.Close()
+	config := DockerMachineConfig{URL: "tcp://" + server.Listener.Addr().String()}
+
+	dockerClient, err := NewClientFromConfig(config, quietLogger, WithMinAPIVersion("1.30"))
+	mustNotError(t, err)
+	if version := dockerClient.ClientVersion(); version != "1.30" {
+		t.Errorf("expected the client to be moved up to 1.30, got %s", version)
+	}
+	for _, opts := range [][]Option{
+		{quietLogger, WithMinAPIVersion("1.30"), StrictAPIVersionRange(true)},
+		{quietLogger, WithMinAPIVersion("1.30"), StrictAPIVersionRange(true), WithClientNegotiation()},
+	} {
+		_, err = NewClientFromConfig(config, opts...)
+		if !errors.Is(err, ErrAPIVersionOutOfRange) || !strings.Contains(err.Error(), "daemon speaks 1.24, wanted 1.30 to any") {
+			t.Errorf("expected ErrAPIVersionOutOfRange, got %v", err)
+		}
+	}
+}
+
+func TestAPIVersionFromEngineVersion(t *testing.T) {
+	for _, test := range []struct {
+		body string
+		api  string
+	}{
+		{`{"Version": "19.03.12"}`, "1.40"},
+		{`{"Version": "17.06.2-ce"}`, "1.30"},
+		{`{"Version": "20.10.24+incompatible"}`, "1.41"},
+		{`{"Version": "1.11.2"}`, "1.24"},
+		{`{"Version": "99.0"}`, "1.46"},
+		{`{"Components": [{"Name": "Engine", "Version": "18.09.1"}]}`, "1.39"},
+		{`{"Version": "master-dockerproject-2019-01-01"}`, api.DefaultVersion},
+		{`{"Version": "dev"}`, api.DefaultVersion},
+		{`{"Version": "v19.03"}`, api.DefaultVersion},
+		{`{}`, api.DefaultVersion},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, test.body)
+		}))
+		logger := &recordingLogger{}
+		apiVersion, err := determineApiVersion(context.Background(), "tcp://"+server.Listener.Addr().String(), "/version", false, nil, http.DefaultClient, logger)
+		server.Close()
+		mustNotError(t, err)
+		if apiVersion != test.api {
+			t.Errorf("%s: expected %s, got %s", test.body, test.api, apiVersion)
+		}
+		if !logger.logged("No ApiVersion in the daemon's version response") {
+			t.Errorf("%s: expected a warning, got %q", test.body, logger.messages)
+		}
+	}
+}
+
+func TestCACertPathWithComma(t *testing.T) {
+	pki := newTestPKI(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	userDir := filepath.Join(dir, "Doe, John")
+	mustNotError(t, os.Mkdir(userDir, 0700))
+	path := filepath.Join(userDir, "ca.pem")
+	writeFile(t, path, pki.caPEM)
+	caCertPEM, err := readCACertFiles(path)
+	mustNotError(t, err)
+	if string(caCertPEM) != string(pki.caPEM) {
+		t.Errorf("expected the file to be read whole")
+	}
+}
+
+func TestMultipleCACerts(t *testing.T) {
+	root, intermediate := newTestPKI(t), newTestPKI(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	rootPath, intermediatePath := filepath.Join(dir, "root.pem"), filepath.Join(dir, "intermediate.pem")
+	writeFile(t, rootPath, root.caPEM)
+	writeFile(t, intermediatePath, intermediate.caPEM)
+	bundlePath := filepath.Join(dir, "bundle.pem")
+	writeFile(t, bundlePath, append(append([]byte{}, root.caPEM...), intermediate.caPEM...))
+	isolated := newOptions([]Option{quietLogger, WithIsolatedTrust(true)})
+
+	for name, caCertPath := range map[string]string{
+		"bundle":          bundlePath,
+		"comma-separated": rootPath + ", " + intermediatePath,
+	} {
+		caCertPEM, err := readCACertFiles(caCertPath)
+		mustNotError(t, err)
+		tlsConfig, err := isolated.buildTLSConfig(caCertPath, "cert.pem", caCertPEM, root.clientCertPEM, root.clientKeyPEM)
+		mustNotError(t, err)
+		if subjects := tlsConfig.RootCAs.Subjects(); len(subjects) != 2 {
+			t.Errorf("%s: expected both CAs, got %d", name, len(subjects))
+		}
+	}
+
+	withAdditional := newOptions([]Option{quietLogger, WithIsolatedTrust(true), WithAdditionalCAs([]string{intermediatePath})})
+	tlsConfig, err := withAdditional.buildTLSConfig(rootPath, "cert.pem", root.caPEM, root.clientCertPEM, root.clientKeyPEM)
+	mustNotError(t, err)
+	if subjects := tlsConfig.RootCAs.Subjects(); len(subjects) != 2 {
+		t.Errorf("expected the additional CA alongside the machine's, got %d", len(subjects))
+	}
+	_, err = readCACertFiles(rootPath + "," + filepath.Join(dir, "missing.pem"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the missing file in the list to be reported, got %v", err)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	mutex := sync.Mutex{}
+	userAgents := map[string]string{}
+	daemon := versionHandler("1.40")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		userAgents[r.URL.Path] = r.UserAgent()
+		mutex.Unlock()
+		daemon.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	config := DockerMachineConfig{URL: "tcp://" + server.Listener.Addr().String()}
+	for _, opts := range [][]Option{
+		{quietLogger, WithUserAgent("ci-runner/1.2")},
+		{quietLogger, WithUserAgent("ci-runner/1.2"), WithClientNegotiation()},
+	} {
+		dockerClient, err := NewClientFromConfig(config, opts...)
+		mustNotError(t, err)
+		_, err = dockerClient.Ping(context.Background())
+		mustNotError(t, err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, path := range []string{"/version", "/_ping"} {
+		if userAgents[path] != "ci-runner/1.2" {
+			t.Errorf("expected the user agent on %s, got %q", path, userAgents[path])
+		}
+	}
+}
+
+func TestConfigTimeout(t *testing.T) {
+	defer func(old func(context.Context, []string, string, ...string) ([]string, error)) { commandRunner = old }(commandRunner)
+	commandRunner = func(ctx context.Context, _ []string, _ string, _ ...string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	start := time.Now()
+	_, err := ResolveConfig("dev", quietLogger, WithConfigTimeout(50*time.Millisecond), WithProbeTimeout(time.Hour))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the config stage to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the config timeout to apply, took %s", elapsed)
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	config := DockerMachineConfig{URL: "tcp://" + server.Listener.Addr().String()}
+	for _, opts := range [][]Option{
+		{quietLogger, WithProbeTimeout(50 * time.Millisecond), WithConfigTimeout(time.Hour)},
+		{quietLogger, WithProbeTimeout(50 * time.Millisecond), WithClientNegotiation()},
+	} {
+		start := time.Now()
+		_, err := NewClientFromConfig(config, opts...)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the probe to time out, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("expected the probe timeout to apply, took %s", elapsed)
+		}
+	}
+}
+
+func TestProbeURLWithZone(t *testing.T) {
+	for _, host := range []string{"tcp://[fe80::1%en0]:2376", "tcp://[fe80::1%25en0]:2376"} {
+		probe, err := probeURL(host, "/version", true)
+		mustNotError(t, err)
+		if probe != "https://[fe80::1%25en0]:2376/version" {
+			t.Errorf("%s: expected the zone to be kept, got %q", host, probe)
+		}
+	}
+	// Building the client parses the host as well
+	dockerClient, err := NewClientFromConfig(DockerMachineConfig{URL: "tcp://[fe80::1%en0]:2376"}, quietLogger, WithAPIVersion("1.40"))
+	mustNotError(t, err)
+	if host := dockerClient.DaemonHost(); host != "tcp://[fe80::1%25en0]:2376" {
+		t.Errorf("unexpected host %q", host)
+	}
+}
+
+func TestIPv6Daemon(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback")
+	}
+	server := httptest.NewUnstartedServer(versionHandler("1.40"))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+	config := DockerMachineConfig{URL: "tcp://" + listener.Addr().String()}
+	if !strings.HasPrefix(config.URL, "tcp://[::1]:") {
+		t.Fatalf("expected a bracketed literal, got %q", config.URL)
+	}
+	dockerClient, err := NewClientFromConfig(config, quietLogger)
+	mustNotError(t, err)
+	if version := dockerClient.ClientVersion(); version != "1.40" {
+		t.Errorf("expected 1.40, got %q", version)
+	}
+	_, err = dockerClient.Ping(context.Background())
+	mustNotError(t, err)
+}
+
+func TestDockerAPIVersionEnv(t *testing.T) {
+	var probes int32
+	daemon := versionHandler("1.40")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/version" {
+			atomic.AddInt32(&probes, 1)
+		}
+		daemon.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	config := DockerMachineConfig{URL: "tcp://" + server.Listener.Addr().String()}
+	defer setenv("DOCKER_API_VERSION", "")()
+	for _, test := range []struct {
+		env     string
+		opts    []Option
+		version string
+		probes  int32
+	}{
+		{"", nil, "1.40", 1},
+		{"1.30", nil, "1.30", 0},
+		{"1.30", []Option{WithAPIVersion("1.35")}, "1.35", 0},
+		{"1.30", []Option{WithClientNegotiation()}, "1.30", 0},
+	} {
+		os.Setenv("DOCKER_API_VERSION", test.env)
+		atomic.StoreInt32(&probes, 0)
+		dockerClient, err := NewClientFromConfig(config, append([]Option{quietLogger}, test.opts...)...)
+		mustNotError(t, err)
+		if version := dockerClient.ClientVersion(); version != test.version {
+			t.Errorf("DOCKER_API_VERSION=%q: expected %s, got %s", test.env, test.version, version)
+		}
+		if probed := atomic.LoadInt32(&probes); probed != test.probes {
+			t.Errorf("DOCKER_API_VERSION=%q: expected %d probes, got %d", test.env, test.probes, probed)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig("--tlsverify\r\n--tlscacert=\"/certs/ca.pem\"\n\n-H=tcp://192.168.99.100:2376 --tlscert=\"/certs/cert.pem\" --tlskey=\"/certs/key.pem\"\n")
+	mustNotError(t, err)
+	if config.URL != "tcp://192.168.99.100:2376" || !config.TLSVerify || config.TLSKey != "/certs/key.pem" {
+		t.Errorf("unexpected config %+v", config)
+	}
+	for _, output := range []string{
+		"",
+		"--tlsverify",
+		"WARNING: something\n-H=tcp://host:2376",
+		"--tlscert\n-H=tcp://host:2376",
+	} {
+		if _, err := ParseConfig(output); err == nil {
+			t.Errorf("%q: expected an error", output)
+		}
+	}
+}
+
+func TestIgnoredConfigKeys(t *testing.T) {
+	output := "-D --debug --storage-driver=overlay2 --log-level=debug\n-H=tcp://192.168.99.100:2376"
+	logger := &recordingLogger{}
+	config := configFromRawConfig(parseRawDockerMachineOutput(strings.Split(output, "\n")), logger)
+	if config.URL != "tcp://192.168.99.100:2376" {
+		t.Errorf("expected the host, got %q", config.URL)
+	}
+	if len(logger.messages) != 0 {
+		t.Errorf("expected the irrelevant flags to pass quietly, got %q", logger.messages)
+	}
+	config, err := ParseConfig(output)
+	mustNotError(t, err)
+	if config.URL != "tcp://192.168.99.100:2376" {
+		t.Errorf("expected ParseConfig to find the host, got %q", config.URL)
+	}
+}
+
+func TestParseConfigLeavesUnknownKeysToConnections(t *testing.T) {
+	// Reported keys are remembered package-wide, past this run
+	reportedConfigKeys.Delete("parse-config-only")
+	defer reportedConfigKeys.Delete("parse-config-only")
+	_, err := ParseConfig("-H=tcp://host:2376\n--parse-config-only=yes")
+	mustNotError(t, err)
+	logger := &recordingLogger{}
+	configFromRawConfig(map[string]string{"H": "tcp://host:2376", "parse-config-only": "yes"}, logger)
+	if !logger.logged("Unknown config: parse-config-only=yes") {
+		t.Errorf("expected the unknown key to be logged on connecting, got %q", logger.messages)
+	}
+}
+
+func TestCertsIgnoredWithoutTLSVerify(t *testing.T) {
+	pki := newTestPKI(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	pki.writeCerts(t, dir)
+	defer withCommandRunner(configRunner(
+		`--tlsverify=false`,
+		`--tlscacert="`+filepath.Join(dir, "ca.pem")+`"`,
+		`--tlscert="`+filepath.Join(dir, "cert.pem")+`"`,
+		`--tlskey="`+filepath.Join(dir, "key.pem")+`"`,
+		`-H=tcp://192.168.99.100:2375`,
+	))()
+	tlsConfig, err := BuildTLSConfig("dev", quietLogger, WithIsolatedTrust(true), StrictCertExpiry(true))
+	mustNotError(t, err)
+	if tlsConfig != nil {
+		t.Errorf("expected no TLS config for a machine with tlsverify off")
+	}
+	httpClient, err := newOptions([]Option{quietLogger}).newHTTPClient("tcp://192.168.99.100:2375", tlsConfig)
+	mustNotError(t, err)
+	if transportUsesTLS(httpClient) {
+		t.Errorf("expected a transport without TLS")
+	}
+}
+
+func TestSubprocessLocale(t *testing.T) {
+	envBinary, err := exec.LookPath("env")
+	if err != nil {
+		t.Skip("no env to stand in for docker-machine")
+	}
+	defer setenv("LANG", "de_DE.UTF-8")()
+	defer setenv("LC_ALL", "de_DE.UTF-8")()
+	o := newOptions([]Option{quietLogger, WithBinaryPath(envBinary)})
+	items, err := o.getOutputItemsFromDockerMachine(context.Background())
+	mustNotError(t, err)
+	for _, variable := range []string{"LANG=C", "LC_ALL=C"} {
+		if !containsString(items, variable) {
+			t.Errorf("expected %s in the command's environment", variable)
+		}
+	}
+	if containsString(items, "LANG=de_DE.UTF-8") {
+		t.Errorf("expected the caller's locale to be overridden")
+	}
+}
+
+func TestLocalizedChatterIgnored(t *testing.T) {
+	logger := &recordingLogger{}
+	config := configFromRawConfig(parseRawDockerMachineOutput([]string{
+		"Achtung: das Zertifikat läuft bald ab",
+		"警告: 証明書の有効期限が近づいています",
+		`-H=tcp://192.168.99.100:2376`,
+	}), logger)
+	if config.URL != "tcp://192.168.99.100:2376" {
+		t.Errorf("expected the host despite the chatter, got %q", config.URL)
+	}
+	if len(logger.messages) != 0 {
+		t.Errorf("expected the chatter to be skipped quietly, got %q", logger.messages)
+	}
+}
+
+func TestPreflightDNS(t *testing.T) {
+	config := DockerMachineConfig{URL: "tcp://stale-vm.invalid:2376"}
+	start := time.Now()
+	_, err := NewClientFromConfig(config, quietLogger, WithPreflightDNS(), WithProbeTimeout(time.Hour))
+	if !errors.Is(err, ErrHostUnresolvable) {
+		t.Errorf("expected ErrHostUnresolvable, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("expected to fail before probing, took %s", elapsed)
+	}
+	for _, host := range []string{"tcp://192.168.99.100:2376", "tcp://[::1]:2376", "tcp://[fe80::1%25en0]:12376", "unix:///var/run/docker.sock"} {
+		if err := resolveDockerHost(context.Background(), host); err != nil {
+			t.Errorf("%s: expected no lookup to be needed, got %v", host, err)
+		}
+	}
+}
+
+func TestPinnedServerCert(t *testing.T) {
+	pki := newTestPKI(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	pki.writeCerts(t, dir)
+	server := pki.tlsServer(versionHandler("1.40"))
+	defer server.Close()
+	sum := sha256.Sum256(pki.serverCert.Certificate[0])
+	fingerprint := hex.EncodeToString(sum[:])
+
+	// As openssl prints it
+	var pairs []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		pairs = append(pairs, strings.ToUpper(fingerprint[i:i+2]))
+	}
+	_, err := NewClientFromConfig(tlsMachineConfig(dir, server), quietLogger, WithPinnedServerCert(strings.Join(pairs, ":")))
+	mustNotError(t, err)
+
+	// The fingerprint of some other daemon's cert
+	other := newTestPKI(t).serverCert.Certificate[0]
+	sum = sha256.Sum256(other)
+	_, err = NewClientFromConfig(tlsMachineConfig(dir, server), quietLogger, WithPinnedServerCert(hex.EncodeToString(sum[:])))
+	if err == nil || !strings.Contains(err.Error(), "does not match the pinned") {
+		t.Errorf("expected a mismatched pin to fail the handshake, got %v", err)
+	}
+
+	for _, pin := range []string{"not hex", fingerprint[:40], fingerprint + "00"} {
+		_, err = NewClientFromConfig(tlsMachineConfig(dir, server), quietLogger, WithPinnedServerCert(pin))
+		if err == nil || !strings.Contains(err.Error(), "64 hex characters") {
+			t.Errorf("%q: expected the pin to be refused, got %v", pin, err)
+		}
+	}
+}
+
+// Records when each write arrived.
+type timedWriter struct {
+	mutex  sync.Mutex
+	output strings.Builder
+	times  []time.Time
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.times = append(w.times, time.Now())
+	return w.output.Write(p)
+}
+
+func TestProgressIsStreamed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake docker-machine is a shell script")
+	}
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	script := filepath.Join(dir, "docker-machine")
+	writeFile(t, script, []byte("#!/bin/sh\necho \"Starting $2...\"\nsleep 1\necho 'Waiting for an IP...' >&2\n"))
+	mustNotError(t, os.Chmod(script, 0755))
+
+	output := &timedWriter{}
+	o := newOptions([]Option{quietLogger, WithBinaryPath(script), WithProgressOutput(output)})
+	mustNotError(t, o.runDockerMachine(context.Background(), "start", "dev"))
+	finished := time.Now()
+	if got := output.output.String(); got != "Starting dev...\nWaiting for an IP...\n" {
+		t.Errorf("expected stdout and stderr to be copied, got %q", got)
+	}
+	if len(output.times) == 0 || finished.Sub(output.times[0]) < 500*time.Millisecond {
+		t.Errorf("expected the first line long before the command finished")
+	}
+
+	writeFile(t, script, []byte("#!/bin/sh\necho 'Host does not exist: \"dev\"' >&2\nexit 1\n"))
+	err := o.runDockerMachine(context.Background(), "start", "dev")
+	if err == nil || !strings.Contains(err.Error(), `Host does not exist: "dev"`) {
+		t.Errorf("expected stderr in the error, got %v", err)
+	}
+}
+
+func TestEnginePort(t *testing.T) {
+	for _, test := range []struct {
+		host     string
+		expected string
+	}{
+		{"tcp://192.168.99.100:2376", "tcp://192.168.99.100:12376"},
+		{"tcp://[fe80::1]:2376", "tcp://[fe80::1]:12376"},
+		{"tcp://[fe80::1%en0]:2376", "tcp://[fe80::1%25en0]:12376"},
+		{"unix:///var/run/docker.sock", "unix:///var/run/docker.sock"},
+	} {
+		restore := withCommandRunner(configRunner("-H=" + test.host))
+		config, err := ResolveConfig("dev", quietLogger, WithEnginePort(12376))
+		restore()
+		mustNotError(t, err)
+		if config.URL != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.host, test.expected, config.URL)
+		}
+	}
+}
+
+// Every way the package builds a client, against the docker module in
+// go.mod, down to a request made with each.
+func TestClientsFromDockerModule(t *testing.T) {
+	server := httptest.NewServer(versionHandler("1.40"))
+	defer server.Close()
+	host := "tcp://" + server.Listener.Addr().String()
+	defer setenv("DOCKER_HOST", host)()
+	defer setenv("DOCKER_TLS_VERIFY", "")()
+	defer setenv("DOCKER_CERT_PATH", "")()
+	defer setenv("DOCKER_API_VERSION", "")()
+
+	probed, err := NewClientFromConfig(DockerMachineConfig{URL: host}, quietLogger)
+	mustNotError(t, err)
+	negotiated, err := NewClientFromConfig(DockerMachineConfig{URL: host}, quietLogger, WithClientNegotiation())
+	mustNotError(t, err)
+	fromEnv, err := EnvClientSupplier()
+	mustNotError(t, err)
+	for name, dockerClient := range map[string]*client.Client{"probed": probed, "negotiated": negotiated, "from env": fromEnv} {
+		if daemonHost := dockerClient.DaemonHost(); daemonHost != host {
+			t.Errorf("%s: expected host %q, got %q", name, host, daemonHost)
+		}
+		ping, err := dockerClient.Ping(context.Background())
+		mustNotError(t, err)
+		if ping.APIVersion != "1.40" {
+			t.Errorf("%s: expected the stub's version, got %q", name, ping.APIVersion)
+		}
+	}
+}
+
+func TestProbeRedirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			t.Errorf("expected the redirect not to be followed")
+			return
+		}
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}))
+	defer server.Close()
+	_, err := NewClientFromConfig(DockerMachineConfig{URL: "tcp://" + server.Listener.Addr().String()}, quietLogger)
+	if err == nil || !strings.Contains(err.Error(), `unexpected redirect during version probe: 302 Found to "/login"`) {
+		t.Errorf("expected the redirect to be reported, got %v", err)
+	}
+}
+
+func TestCertExpiry(t *testing.T) {
+	pki := newTestPKI(t)
+	for _, test := range []struct {
+		notAfter time.Time
+		message  string
+	}{
+		{time.Now().Add(-time.Minute), "cert.pem expired at"},
+		{time.Now().Add(2 * time.Hour), "cert.pem expires at"},
+	} {
+		certPEM, keyPEM := pki.issue(t, &x509.Certificate{
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, test.notAfter)
+		logger := &recordingLogger{}
+		_, err := newOptions([]Option{WithLogger(logger), WithCertExpiryWindow(24 * time.Hour)}).buildTLSConfig("ca.pem", "cert.pem", pki.caPEM, certPEM, keyPEM)
+		mustNotError(t, err)
+		if !logger.logged(test.message) {
+			t.Errorf("expected a warning that the %s, got %q", test.message, logger.messages)
+		}
+		_, err = newOptions([]Option{quietLogger, WithCertExpiryWindow(24 * time.Hour), StrictCertExpiry(true)}).buildTLSConfig("ca.pem", "cert.pem", pki.caPEM, certPEM, keyPEM)
+		if !errors.Is(err, ErrCertExpiringSoon) || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("expected ErrCertExpiringSoon saying the %s, got %v", test.message, err)
+		}
+	}
+
+	// Well outside the window, nothing to say
+	logger := &recordingLogger{}
+	_, err := newOptions([]Option{WithLogger(logger), StrictCertExpiry(true), WithCertExpiryWindow(time.Hour)}).buildTLSConfig("ca.pem", "cert.pem", pki.caPEM, pki.clientCertPEM, pki.clientKeyPEM)
+	mustNotError(t, err)
+	if len(logger.messages) != 0 {
+		t.Errorf("expected no warning, got %q", logger.messages)
+	}
+}
+
+func TestProbeStatusErrors(t *testing.T) {
+	for _, test := range []struct {
+		status  int
+		message string
+	}{
+		{http.StatusUnauthorized, "version probe returned 401 Unauthorized, the daemon or a proxy in front of it refused the request"},
+		{http.StatusForbidden, "version probe returned 403 Forbidden, the daemon or a proxy in front of it refused the request"},
+		{http.StatusBadGateway, "version probe returned 502 Bad Gateway, a proxy could not reach the daemon"},
+		{http.StatusInternalServerError, "version probe returned 500 Internal Server Error"},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "<html>Access denied</html>", test.status)
+		}))
+		_, err := NewClientFromConfig(DockerMachineConfig{URL: "tcp://" + server.Listener.Addr().String()}, quietLogger)
+		server.Close()
+		if err == nil || !strings.HasSuffix(err.Error(), test.message) {
+			t.Errorf("%d: expected %q, got %v", test.status, test.message, err)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package docker_machine_helper
+
+// Receives the package's diagnostic messages. A *log.Logger satisfies
+// it as-is.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Adapts a plain function, such as a zap SugaredLogger's Debugf, into
+// a Logger.
+type LoggerFunc func(format string, v ...interface{})
+
+func (f LoggerFunc) Printf(format string, v ...interface{}) {
+	f(format, v...)
+}
@@ -0,0 +1,254 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/client"
+	"os/exec"
+	"strings"
+	"unicode"
+)
+
+// One row of `docker-machine ls`.
+type MachineInfo struct {
+	Name  string
+	State string
+	URL   string
+}
+
+// Lists the machines `docker-machine` knows about, whatever their state.
+// The URL is empty for machines that aren't running.
+func ListMachines(opts ...Option) ([]MachineInfo, error) {
+	return newOptions(opts).listMachines(context.Background())
+}
+
+func (o *options) listMachines(ctx context.Context) ([]MachineInfo, error) {
+	items, err := o.getOutputItemsFromDockerMachine(ctx, "ls", "--format", "{{.Name}}\t{{.State}}\t{{.URL}}")
+	if err != nil {
+		return nil, err
+	}
+	machines := []MachineInfo{}
+	for _, line := range items {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 3)
+		for len(fields) < 3 {
+			fields = append(fields, "")
+		}
+		machines = append(machines, MachineInfo{
+			Name:  strings.TrimSpace(fields[0]),
+			State: strings.TrimSpace(fields[1]),
+			URL:   strings.TrimSpace(fields[2]),
+		})
+	}
+	return machines, nil
+}
+
+// Builds a client for every running machine, keyed by machine name, for
+// callers watching all of them at once. Machines that failed are left
+// out of the map and listed in the error, so both may be returned.
+// IncludeStoppedMachines tries the other machines too. There is no
+// fallback: any supplier given is ignored.
+func ClientsForAllMachines(ctx context.Context, opts ...Option) (map[string]*client.Client, error) {
+	o := newOptions(opts)
+	machines, err := o.listMachines(ctx)
+	if err != nil {
+		return nil, err
+	}
+	clients := map[string]*client.Client{}
+	failures := &machinesError{}
+	for _, machine := range machines {
+		if machine.State != "Running" && !o.includeStoppedMachines {
+			continue
+		}
+		machineOpts := append(append([]Option{}, opts...), WithMachineName(machine.Name), WithFallbackSupplier(nil))
+		dockerClient, err := NewClientFactory(machineOpts...).Client(ctx)
+		if err != nil {
+			failures.names = append(failures.names, machine.Name)
+			failures.errs = append(failures.errs, err)
+			continue
+		}
+		clients[machine.Name] = dockerClient
+	}
+	if len(failures.errs) > 0 {
+		return clients, failures
+	}
+	return clients, nil
+}
+
+// Every machine ClientsForAllMachines couldn't build a client for.
+type machinesError struct {
+	names []string
+	errs  []error
+}
+
+func (e *machinesError) Error() string {
+	messages := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		messages[i] = fmt.Sprintf("machine %q: %s", e.names[i], err)
+	}
+	return fmt.Sprintf("could not connect to %d machines: %s", len(e.errs), strings.Join(messages, "; "))
+}
+
+// Reports the state of the named machine, such as "Running" or
+// "Stopped", without building a client. A machine that doesn't exist is
+// reported as ErrMachineNotFound.
+func MachineStatus(machineName string, opts ...Option) (string, error) {
+	return newOptions(opts).machineStatus(context.Background(), machineName)
+}
+
+func (o *options) machineStatus(ctx context.Context, machineName string) (string, error) {
+	args, err := machineArgs(machineName, "status")
+	if err != nil {
+		return "", err
+	}
+	items, err := o.getOutputItemsFromDockerMachine(ctx, args...)
+	if err != nil {
+		// docker-machine fails the same way for a missing machine as for
+		// any other problem, so check whether it's actually there
+		if machines, listErr := o.listMachines(ctx); listErr == nil && machineName != "" && !containsMachine(machines, machineName) {
+			err = &causedError{kind: ErrMachineNotFound, cause: err}
+		}
+		return "", fmt.Errorf("could not get status of %s: %w", describeMachine(machineName), err)
+	}
+	return strings.TrimSpace(strings.Join(items, "\n")), nil
+}
+
+func containsMachine(machines []MachineInfo, machineName string) bool {
+	for _, machine := range machines {
+		if machine.Name == machineName {
+			return true
+		}
+	}
+	return false
+}
+
+// Starts the named machine with `docker-machine start`, waiting for it
+// to come up. On failure the error includes what the command wrote to
+// stderr.
+func StartMachine(machineName string, opts ...Option) error {
+	return newOptions(opts).startMachine(context.Background(), machineName)
+}
+
+func (o *options) startMachine(ctx context.Context, machineName string) error {
+	args, err := machineArgs(machineName, "start")
+	if err != nil {
+		return err
+	}
+	if err := o.runDockerMachine(ctx, args...); err != nil {
+		return fmt.Errorf("could not start %s: %w", describeMachine(machineName), err)
+	}
+	return nil
+}
+
+// Starts the machine if AutoStart was asked for and it isn't already
+// running. A machine whose status can't be read is left alone, so the
+// usual failure and fallback apply.
+func (o *options) ensureMachineRunning(ctx context.Context, machineName string) error {
+	if !o.autoStart {
+		return nil
+	}
+	status, err := o.machineStatus(ctx, machineName)
+	if err != nil || status == "Running" {
+		return nil
+	}
+	o.logger.Printf("Starting %s, which is %s", describeMachine(machineName), status)
+	return o.startMachine(ctx, machineName)
+}
+
+// Appends the machine name to a subcommand's arguments, leaving it out
+// when empty so `docker-machine` picks its usual default.
+func machineArgs(machineName string, args ...string) ([]string, error) {
+	if err := validateMachineName(machineName); err != nil {
+		return nil, err
+	}
+	if machineName != "" {
+		args = append(args, machineName)
+	}
+	return args, nil
+}
+
+// The name reaches docker-machine as a single argument, never through a
+// shell, so spaces are fine. Blank names and control characters such as
+// newlines are not, the latter because they would break apart the line
+// based output we parse.
+func validateMachineName(machineName string) error {
+	if machineName == "" {
+		return nil
+	}
+	if strings.TrimSpace(machineName) == "" {
+		return fmt.Errorf("%w: %q is blank", ErrInvalidMachineName, machineName)
+	}
+	for _, r := range machineName {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w: %q contains control characters", ErrInvalidMachineName, machineName)
+		}
+	}
+	return nil
+}
+
+// Whether the named machine's daemon, an empty name meaning the active
+// one's, answers a version probe, for health checks in a loop where
+// building a whole client each time would be wasteful. No docker client
+// is built, and the probe's connections are closed before returning.
+// The error says why it couldn't connect.
+func CanConnect(ctx context.Context, machineName string, opts ...Option) (bool, error) {
+	o := newOptions(opts)
+	config, err := o.getDockerMachineConfig(ctx, machineName)
+	if err != nil {
+		return false, err
+	}
+	tlsConfig, err := o.loadTLSConfig(machineName, config)
+	if err != nil {
+		return false, err
+	}
+	httpClient, err := o.newHTTPClient(config.URL, tlsConfig)
+	if err != nil {
+		return false, err
+	}
+	if o.httpClient == nil {
+		defer httpClient.CloseIdleConnections()
+	}
+	if _, err := o.probeApiVersion(ctx, config.URL, httpClient, transportUsesTLS(httpClient)); err != nil {
+		return false, fmt.Errorf("could not reach %s: %w", describeMachine(machineName), err)
+	}
+	return true, nil
+}
+
+// Whether the `docker-machine` binary, or the one given to
+// WithBinaryPath, can be found, without running it.
+func IsDockerMachineAvailable(opts ...Option) bool {
+	_, err := exec.LookPath(newOptions(opts).binaryPath)
+	return err == nil
+}
+
+// Returns what `docker-machine version` reports, such as
+// "docker-machine version 0.16.2, build bd45ab13". A missing binary is
+// reported as ErrDockerMachineNotInstalled.
+func DockerMachineVersion(opts ...Option) (string, error) {
+	items, err := newOptions(opts).getOutputItemsFromDockerMachine(context.Background(), "version")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.Join(items, "\n")), nil
+}
+
+// Regenerates the named machine's certs with
+// `docker-machine regenerate-certs -f`, for when they no longer match
+// the machine, such as after its IP changed. On failure the error
+// includes what the command wrote to stderr.
+func RegenerateCerts(machineName string, opts ...Option) error {
+	return newOptions(opts).regenerateCerts(context.Background(), machineName)
+}
+
+func (o *options) regenerateCerts(ctx context.Context, machineName string) error {
+	args, err := machineArgs(machineName, "regenerate-certs", "-f")
+	if err != nil {
+		return err
+	}
+	if err := o.runDockerMachine(ctx, args...); err != nil {
+		return fmt.Errorf("could not regenerate certs for %s: %w", describeMachine(machineName), err)
+	}
+	return nil
+}
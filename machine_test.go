@@ -0,0 +1,211 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMachineNameWithSpaces(t *testing.T) {
+	var args []string
+	config := configRunner("-H=tcp://192.168.99.100:2376")
+	defer withCommandRunner(func(given []string) ([]string, error) {
+		if given[0] == "config" {
+			args = given
+		}
+		return config(given)
+	})()
+	_, err := ResolveConfig("dev box", quietLogger)
+	mustNotError(t, err)
+	if expected := []string{"config", "dev box"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %q, got %q", expected, args)
+	}
+}
+
+func TestInvalidMachineNames(t *testing.T) {
+	ran := false
+	defer withCommandRunner(func([]string) ([]string, error) {
+		ran = true
+		return nil, nil
+	})()
+	for _, name := range []string{" ", "\t", "dev\nbox", "dev\rbox", "dev\x00", "dev\x1b[2J"} {
+		if _, err := ResolveConfig(name, quietLogger); !errors.Is(err, ErrInvalidMachineName) {
+			t.Errorf("%q: expected ErrInvalidMachineName, got %v", name, err)
+		}
+	}
+	if ran {
+		t.Errorf("expected docker-machine never to run for an invalid name")
+	}
+}
+
+func TestCanConnect(t *testing.T) {
+	pki := newTestPKI(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	pki.writeCerts(t, dir)
+	server := pki.tlsServer(versionHandler("1.40"))
+	config := tlsMachineConfig(dir, server)
+	defer withCommandRunner(configRunner(
+		"--tlsverify",
+		"--tlscacert="+config.TLSCaCert,
+		"--tlscert="+config.TLSCert,
+		"--tlskey="+config.TLSKey,
+		"-H="+config.URL,
+	))()
+
+	ok, err := CanConnect(context.Background(), "dev", quietLogger)
+	mustNotError(t, err)
+	if !ok {
+		t.Errorf("expected the daemon to be reachable")
+	}
+
+	server.Close()
+	ok, err = CanConnect(context.Background(), "dev", quietLogger)
+	if ok || err == nil || !strings.Contains(err.Error(), `could not reach machine "dev"`) {
+		t.Errorf("expected a closed daemon to be unreachable, got %v, %v", ok, err)
+	}
+}
+
+func TestListMachines(t *testing.T) {
+	var args []string
+	defer withCommandRunner(func(given []string) ([]string, error) {
+		args = given
+		return []string{
+			"dev\tRunning\ttcp://192.168.99.100:2376",
+			"old\tStopped\t",
+			"  ",
+			"broken\tError",
+		}, nil
+	})()
+	machines, err := ListMachines(quietLogger)
+	mustNotError(t, err)
+	if args[0] != "ls" || args[1] != "--format" {
+		t.Errorf("expected a formatted ls, got %q", args)
+	}
+	expected := []MachineInfo{
+		{Name: "dev", State: "Running", URL: "tcp://192.168.99.100:2376"},
+		{Name: "old", State: "Stopped"},
+		{Name: "broken", State: "Error"},
+	}
+	if !reflect.DeepEqual(machines, expected) {
+		t.Errorf("expected %+v, got %+v", expected, machines)
+	}
+}
+
+func TestMachineStatus(t *testing.T) {
+	listed := []string{"dev\tStopped\t"}
+	defer withCommandRunner(func(args []string) ([]string, error) {
+		switch {
+		case args[0] == "ls":
+			return listed, nil
+		case args[0] == "status" && args[1] == "dev":
+			return []string{"Stopped"}, nil
+		}
+		return nil, fmt.Errorf("exit status 1: Host does not exist: %q", args[1])
+	})()
+	status, err := MachineStatus("dev", quietLogger)
+	mustNotError(t, err)
+	if status != "Stopped" {
+		t.Errorf("expected Stopped, got %q", status)
+	}
+
+	_, err = MachineStatus("gone", quietLogger)
+	if !errors.Is(err, ErrMachineNotFound) {
+		t.Errorf("expected a machine missing from ls to be ErrMachineNotFound, got %v", err)
+	}
+
+	// Listed, so the failure is something else
+	listed = append(listed, "gone\tError\t")
+	_, err = MachineStatus("gone", quietLogger)
+	if err == nil || errors.Is(err, ErrMachineNotFound) {
+		t.Errorf("expected a listed machine not to be ErrMachineNotFound, got %v", err)
+	}
+}
+
+func TestAutoStart(t *testing.T) {
+	server := httptest.NewServer(versionHandler("1.40"))
+	defer server.Close()
+	for _, autoStart := range []bool{true, false} {
+		var calls []string
+		state := "Stopped"
+		restore := withCommandRunner(func(args []string) ([]string, error) {
+			calls = append(calls, args[0])
+			switch args[0] {
+			case "status":
+				return []string{state}, nil
+			case "start":
+				state = "Running"
+				return []string{"Starting \"dev\"..."}, nil
+			case "config":
+				if state != "Running" {
+					return nil, errors.New(`exit status 1: Host is not running`)
+				}
+				return []string{"-H=tcp://" + server.Listener.Addr().String()}, nil
+			}
+			return nil, fmt.Errorf("exit status 1: cannot run %q here", args)
+		})
+		_, err := NewClientFactory(quietLogger, WithMachineName("dev"), AutoStart(autoStart)).Client(context.Background())
+		restore()
+		if !autoStart {
+			if err == nil || containsString(calls, "start") || containsString(calls, "status") {
+				t.Errorf("expected no start without AutoStart, got %v after %q", err, calls)
+			}
+			continue
+		}
+		mustNotError(t, err)
+		if len(calls) < 3 || !reflect.DeepEqual(calls[:3], []string{"status", "start", "config"}) {
+			t.Errorf("expected the machine started before resolving its config, got %q", calls)
+		}
+	}
+}
+
+func TestClientsForAllMachines(t *testing.T) {
+	server := httptest.NewServer(versionHandler("1.40"))
+	defer server.Close()
+	var configured []string
+	defer withCommandRunner(func(args []string) ([]string, error) {
+		switch args[0] {
+		case "ls":
+			return []string{"dev\tRunning\t", "old\tStopped\t", "broken\tRunning\t"}, nil
+		case "config":
+			configured = append(configured, args[1])
+			if args[1] == "broken" {
+				return nil, errors.New("exit status 1: Error checking TLS connection: connection refused")
+			}
+			return []string{"-H=tcp://" + server.Listener.Addr().String()}, nil
+		}
+		return nil, fmt.Errorf("exit status 1: cannot run %q here", args)
+	})()
+
+	for _, test := range []struct {
+		includeStopped bool
+		clients        []string
+	}{
+		{false, []string{"dev"}},
+		{true, []string{"dev", "old"}},
+	} {
+		configured = nil
+		clients, err := ClientsForAllMachines(context.Background(), quietLogger, WithFallbackSupplier(NoopSupplier), IncludeStoppedMachines(test.includeStopped))
+		var failures *machinesError
+		if !errors.As(err, &failures) || !reflect.DeepEqual(failures.names, []string{"broken"}) {
+			t.Errorf("expected only broken to fail, got %v", err)
+		} else if !strings.Contains(err.Error(), `machine "broken": `) {
+			t.Errorf("expected the failure named, got %v", err)
+		}
+		if len(clients) != len(test.clients) {
+			t.Errorf("expected clients for %q alongside the error, got %d", test.clients, len(clients))
+		}
+		for _, name := range test.clients {
+			if clients[name] == nil {
+				t.Errorf("expected a client for %s", name)
+			}
+		}
+		if !test.includeStopped && containsString(configured, "old") {
+			t.Errorf("expected the stopped machine to be skipped")
+		}
+	}
+}
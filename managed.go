@@ -0,0 +1,45 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"github.com/docker/docker/client"
+)
+
+// A docker client along with the knowledge of whether its transport
+// belongs to it, for long-running services that build and discard
+// clients and need the connections released each time. Every method of
+// the docker client is available on it.
+type ManagedClient struct {
+	*client.Client
+	ownsTransport bool
+}
+
+// Closes the client's idle connections, unless its transport came from
+// WithHTTPClient, in which case it's left for the caller to manage and
+// Close does nothing.
+func (c *ManagedClient) Close() error {
+	if !c.ownsTransport {
+		return nil
+	}
+	return c.Client.Close()
+}
+
+// The same as GetDockerClientContext, but returns a ManagedClient whose
+// Close releases the connections the package opened.
+func GetManagedDockerClient(ctx context.Context, dockerClientSupplier DockerClientSupplier, opts ...Option) (*ManagedClient, error) {
+	opts = append([]Option{WithFallbackSupplier(dockerClientSupplier)}, opts...)
+	return NewClientFactory(opts...).ManagedClient(ctx)
+}
+
+// The same as Client, but returns a ManagedClient. A client from the
+// fallback supplier was made for this call alone, so it's always closed.
+func (f *ClientFactory) ManagedClient(ctx context.Context) (*ManagedClient, error) {
+	dockerClient, dockerMachineConfig, err := f.ClientWithConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &ManagedClient{
+		Client:        dockerClient,
+		ownsTransport: f.options.httpClient == nil || dockerMachineConfig.UsedFallback,
+	}, nil
+}
@@ -0,0 +1,86 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A daemon counting the connections it has seen closed.
+func closeCountingServer(closed *int32) *httptest.Server {
+	server := httptest.NewUnstartedServer(versionHandler("1.40"))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			atomic.AddInt32(closed, 1)
+		}
+	}
+	server.Start()
+	return server
+}
+
+func waitForClose(closed *int32, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if atomic.LoadInt32(closed) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestManagedClientOwnTransport(t *testing.T) {
+	var closed int32
+	server := closeCountingServer(&closed)
+	defer server.Close()
+	defer withCommandRunner(configRunner("-H=tcp://" + server.Listener.Addr().String()))()
+
+	managed, err := NewClientFactory(quietLogger, WithMachineName("dev")).ManagedClient(context.Background())
+	mustNotError(t, err)
+	if !managed.ownsTransport {
+		t.Errorf("expected the package's own transport to be owned")
+	}
+	_, err = managed.Ping(context.Background())
+	mustNotError(t, err)
+	mustNotError(t, managed.Close())
+	if !waitForClose(&closed, 2*time.Second) {
+		t.Errorf("expected Close to release the idle connections")
+	}
+}
+
+func TestManagedClientCallerTransport(t *testing.T) {
+	var closed int32
+	server := closeCountingServer(&closed)
+	defer server.Close()
+	defer withCommandRunner(configRunner("-H=tcp://" + server.Listener.Addr().String()))()
+	httpClient := &http.Client{Transport: &http.Transport{}}
+
+	managed, err := NewClientFactory(quietLogger, WithMachineName("dev"), WithHTTPClient(httpClient)).ManagedClient(context.Background())
+	mustNotError(t, err)
+	if managed.ownsTransport {
+		t.Errorf("expected the caller's transport to be left to the caller")
+	}
+	_, err = managed.Ping(context.Background())
+	mustNotError(t, err)
+	mustNotError(t, managed.Close())
+	if waitForClose(&closed, 200*time.Millisecond) {
+		t.Errorf("expected the caller's connections to be left open")
+	}
+	httpClient.CloseIdleConnections()
+}
+
+func TestManagedClientFallback(t *testing.T) {
+	defer withCommandRunner(func([]string) ([]string, error) {
+		return nil, errors.New("exit status 1: Host is not running")
+	})()
+	// Made for this call alone, whatever transport was given
+	managed, err := GetManagedDockerClient(context.Background(), NoopSupplier, quietLogger, WithHTTPClient(&http.Client{}))
+	mustNotError(t, err)
+	if !managed.ownsTransport || managed.DaemonHost() != noopHost {
+		t.Errorf("expected the fallback's client to be owned")
+	}
+	mustNotError(t, managed.Close())
+}
@@ -0,0 +1,557 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// How long asking the daemon for its API version may take before
+// giving up, unless WithProbeTimeout says otherwise.
+const defaultProbeTimeout = 10 * time.Second
+
+// How close to expiry the client cert may get before we warn about it,
+// unless WithCertExpiryWindow says otherwise.
+const defaultCertExpiryWindow = 7 * 24 * time.Hour
+
+// Every client talks to a single daemon, so the whole idle pool may as
+// well be available to that one host.
+const (
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// Tweaks how the package finds and talks to `docker-machine`. Options
+// are applied in order, so later options win.
+type Option func(*options)
+
+type options struct {
+	binaryPath             string
+	logger                 Logger
+	negotiateAPIVersion    bool
+	apiVersion             string
+	httpClient             *http.Client
+	probeTimeout           time.Duration
+	strictCACert           bool
+	machineName            string
+	fallbackSupplier       DockerClientSupplier
+	configSource           func(*options, context.Context, string) (DockerMachineConfig, error)
+	rawConfigSource        func(*options, context.Context, string) (map[string]string, error)
+	autoStart              bool
+	certExpiryWindow       time.Duration
+	strictCertExpiry       bool
+	maxIdleConnsPerHost    int
+	idleConnTimeout        time.Duration
+	dockerBinaryPath       string
+	insecureSkipVerify     bool
+	tlsServerName          string
+	retryAttempts          int
+	retryBaseDelay         time.Duration
+	autoRegenerateCerts    bool
+	versionPath            string
+	onStage                StageHook
+	certBytes              *certBytes
+	fallbackDisabled       bool
+	clientNegotiation      bool
+	httpHeaders            map[string]string
+	storagePath            string
+	isolatedTrust          bool
+	proxy                  func(*http.Request) (*url.URL, error)
+	minAPIVersion          string
+	maxAPIVersion          string
+	strictAPIVersionRange  bool
+	additionalCAs          []string
+	configTimeout          time.Duration
+	includeStoppedMachines bool
+	rootless               bool
+	sshTunnel              bool
+	metrics                Metrics
+	preflightDNS           bool
+	pinnedServerCert       string
+	progressOutput         io.Writer
+	enginePort             int
+	pkcs12                 *pkcs12Bundle
+	// Set when httpClient was made by the package rather than given to
+	// WithHTTPClient, as for an SSH tunnel, so its connections are ours
+	// to close
+	ownsHTTPClient bool
+}
+
+// PEM given to WithCertBytes in place of the machine's cert files.
+type certBytes struct {
+	caCert []byte
+	cert   []byte
+	key    []byte
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		binaryPath:          "docker-machine",
+		dockerBinaryPath:    "docker",
+		versionPath:         "/version",
+		logger:              LoggerFunc(log.Printf),
+		probeTimeout:        defaultProbeTimeout,
+		configSource:        (*options).configFromConfigCommand,
+		rawConfigSource:     (*options).rawConfigFromConfigCommand,
+		certExpiryWindow:    defaultCertExpiryWindow,
+		maxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		idleConnTimeout:     defaultIdleConnTimeout,
+		proxy:               http.ProxyFromEnvironment,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Use the `docker-machine` binary at the given path rather than
+// looking it up on the PATH. An empty path keeps the default.
+func WithBinaryPath(path string) Option {
+	return func(o *options) {
+		if path != "" {
+			o.binaryPath = path
+		}
+	}
+}
+
+// Send the package's diagnostics to the given logger rather than the
+// standard library's log package. A nil logger discards them.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		if logger == nil {
+			logger = LoggerFunc(func(string, ...interface{}) {})
+		}
+		o.logger = logger
+	}
+}
+
+// Cap the API version reported by the daemon at the newest version the
+// docker client library supports, so that a daemon newer than the
+// library doesn't cause version-mismatch errors on every call.
+func WithAPIVersionNegotiation() Option {
+	return func(o *options) {
+		o.negotiateAPIVersion = true
+	}
+}
+
+// Talk to the daemon using the given API version instead of asking it
+// which version it speaks, saving a round trip per client. An empty
+// version keeps the default, which is DOCKER_API_VERSION if set and
+// otherwise asking.
+func WithAPIVersion(version string) Option {
+	return func(o *options) {
+		o.apiVersion = version
+	}
+}
+
+// Use at least the given API version, even when the daemon reports an
+// older one, for code relying on newer features. A version given to
+// WithAPIVersion is used as-is. An empty version means no floor.
+func WithMinAPIVersion(version string) Option {
+	return func(o *options) {
+		o.minAPIVersion = version
+	}
+}
+
+// Use at most the given API version, even when the daemon reports a
+// newer one, for code written against an older API. A version given to
+// WithAPIVersion is used as-is. An empty version means no cap.
+func WithMaxAPIVersion(version string) Option {
+	return func(o *options) {
+		o.maxAPIVersion = version
+	}
+}
+
+// Fail with ErrAPIVersionOutOfRange, rather than use the nearer bound,
+// when the daemon's API version is outside the range given to
+// WithMinAPIVersion and WithMaxAPIVersion.
+func StrictAPIVersionRange(strict bool) Option {
+	return func(o *options) {
+		o.strictAPIVersionRange = strict
+	}
+}
+
+// Use the given client, rather than one built by the package, both to
+// ask the daemon for its API version and for the docker client itself.
+// Its timeouts, pooling and dialer are kept. If its transport has no
+// TLS config the machine's is filled in on a copy; if it already has
+// one, that config is used unchanged and the machine's certs are not.
+// The transport must be an *http.Transport, or nil for a default one.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = httpClient
+	}
+}
+
+// Limit how long asking the daemon for its API version may take. The
+// limit only applies to that request, not to the returned client. A
+// zero duration means no limit beyond the context's own deadline.
+func WithProbeTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.probeTimeout = timeout
+	}
+}
+
+// Limit how long each run of `docker-machine` may take, independently
+// of WithProbeTimeout, so a hung subprocess doesn't use up the time
+// meant for the daemon. Each retry gets the full limit. A zero duration
+// means no limit beyond the context's own deadline.
+func WithConfigTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.configTimeout = timeout
+	}
+}
+
+// Look up the docker host's name before asking the daemon anything,
+// failing with ErrHostUnresolvable straight away if it doesn't resolve
+// instead of using up the probe timeout.
+func WithPreflightDNS() Option {
+	return func(o *options) {
+		o.preflightDNS = true
+	}
+}
+
+// Fail, rather than warn and carry on with the system certs, when the
+// machine's CA cert file contributes nothing to the trust pool.
+func StrictCACert(strict bool) Option {
+	return func(o *options) {
+		o.strictCACert = strict
+	}
+}
+
+// Trust only the machine's CA cert when verifying the daemon, rather
+// than adding it to the system roots, to keep the trust surface of
+// machine connections as small as it can be.
+func WithIsolatedTrust(isolated bool) Option {
+	return func(o *options) {
+		o.isolatedTrust = isolated
+	}
+}
+
+// Trust the CA certs in the given PEM files as well as the machine's,
+// for machines whose CA is an intermediate needing the rest of its
+// chain. Each file may hold several certs. Later calls add to the list.
+func WithAdditionalCAs(paths []string) Option {
+	return func(o *options) {
+		o.additionalCAs = append(o.additionalCAs, paths...)
+	}
+}
+
+// Connect to the named machine rather than whichever one
+// `docker-machine` considers active. An empty name means the active one.
+func WithMachineName(machineName string) Option {
+	return func(o *options) {
+		o.machineName = machineName
+	}
+}
+
+// Fall back onto the given supplier when `docker-machine` can't be
+// used. A nil supplier means no fallback.
+func WithFallbackSupplier(dockerClientSupplier DockerClientSupplier) Option {
+	return func(o *options) {
+		o.fallbackSupplier = dockerClientSupplier
+	}
+}
+
+// Read the machine's details from `docker-machine env` instead of
+// `docker-machine config`, for images where only the former is reliable.
+func WithDockerMachineEnvSource() Option {
+	return func(o *options) {
+		o.configSource = (*options).configFromEnvCommand
+		o.rawConfigSource = (*options).rawConfigFromEnvCommand
+	}
+}
+
+// Read the machine's details from DOCKER_HOST, DOCKER_TLS_VERIFY and
+// DOCKER_CERT_PATH, as left by `eval $(docker-machine env)`, skipping
+// the subprocess entirely. The binary is still used when they're unset.
+func WithEnvConfigSource() Option {
+	return func(o *options) {
+		o.configSource = (*options).configFromProcessEnv
+	}
+}
+
+// Start the machine with `docker-machine start` before connecting if it
+// isn't running. Starting a VM is slow and has side effects, so this is
+// off unless asked for.
+func AutoStart(autoStart bool) Option {
+	return func(o *options) {
+		o.autoStart = autoStart
+	}
+}
+
+// Have ClientsForAllMachines try every machine, not just the running
+// ones, for machines whose state docker-machine misreports.
+func IncludeStoppedMachines(include bool) Option {
+	return func(o *options) {
+		o.includeStoppedMachines = include
+	}
+}
+
+// Copy what `docker-machine start` and `docker-machine regenerate-certs`
+// print to the given writer as they run, so users see progress during
+// these slow commands. Config is still read from buffered output. A nil
+// writer keeps them quiet.
+func WithProgressOutput(output io.Writer) Option {
+	return func(o *options) {
+		o.progressOutput = output
+	}
+}
+
+// Warn about a client cert that expires within the given window, rather
+// than the default of a week. A zero window only warns once it has
+// actually expired.
+func WithCertExpiryWindow(window time.Duration) Option {
+	return func(o *options) {
+		o.certExpiryWindow = window
+	}
+}
+
+// Fail with ErrCertExpiringSoon, rather than warn, when the client cert
+// has expired or is within the expiry window.
+func StrictCertExpiry(strict bool) Option {
+	return func(o *options) {
+		o.strictCertExpiry = strict
+	}
+}
+
+// Size the idle connection pool of the transport the package builds,
+// for callers making many concurrent requests. It has no effect on a
+// client given to WithHTTPClient.
+func WithConnectionPool(maxIdleConnsPerHost int, idleConnTimeout time.Duration) Option {
+	return func(o *options) {
+		o.maxIdleConnsPerHost = maxIdleConnsPerHost
+		o.idleConnTimeout = idleConnTimeout
+	}
+}
+
+// Reach tcp daemons through the given proxy instead of the one named by
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY. A nil URL connects directly,
+// whatever the environment says. Sockets are never proxied, and a
+// transport given to WithHTTPClient keeps its own proxy settings.
+func WithProxy(proxyURL *url.URL) Option {
+	return func(o *options) {
+		o.proxy = nil
+		if proxyURL != nil {
+			o.proxy = http.ProxyURL(proxyURL)
+		}
+	}
+}
+
+// Connect through the named docker context, as listed by
+// `docker context ls`, instead of a docker-machine. An empty name keeps
+// the default of asking `docker-machine`.
+func WithDockerContext(contextName string) Option {
+	return func(o *options) {
+		if contextName != "" {
+			o.configSource = dockerContextSource(contextName)
+		}
+	}
+}
+
+// Connect to the daemon on the given port instead of the one
+// docker-machine reports, for daemons moved to another port before
+// docker-machine caught up. The address and certs are kept. Zero keeps
+// the reported port.
+func WithEnginePort(port int) Option {
+	return func(o *options) {
+		o.enginePort = port
+	}
+}
+
+// Skip verifying the daemon's certificate, for dev and test machines
+// whose certificate doesn't match the host they're reached by. Client
+// certs are still presented. This is insecure and logged as such, so
+// prefer WithTLSServerName where it will do.
+func WithInsecureSkipVerify(insecureSkipVerify bool) Option {
+	return func(o *options) {
+		o.insecureSkipVerify = insecureSkipVerify
+	}
+}
+
+// Verify the daemon's certificate against the given name instead of
+// the host docker-machine reported, for machines reached by IP whose
+// certificate names a host. Unlike WithInsecureSkipVerify, the chain is
+// still verified.
+func WithTLSServerName(serverName string) Option {
+	return func(o *options) {
+		o.tlsServerName = serverName
+	}
+}
+
+// Retry getting the machine's config and asking the daemon for its API
+// version, up to the given number of attempts in all, for machines that
+// take a moment to come up. The delay starts at baseDelay and doubles
+// after each attempt. Errors that retrying can't fix, such as a machine
+// that doesn't exist, are returned straight away.
+func WithRetry(attempts int, baseDelay time.Duration) Option {
+	return func(o *options) {
+		o.retryAttempts = attempts
+		o.retryBaseDelay = baseDelay
+	}
+}
+
+// Accept only the daemon certificate with the given SHA-256 fingerprint,
+// in hex, on top of the usual verification, so a cert the CA signed for
+// some other host is turned down too. Regenerating the machine's certs
+// changes the fingerprint. An empty fingerprint pins nothing.
+func WithPinnedServerCert(sha256Hex string) Option {
+	return func(o *options) {
+		o.pinnedServerCert = sha256Hex
+	}
+}
+
+// Run `docker-machine regenerate-certs` once and try again if asking
+// the daemon for its API version fails on TLS. Regenerating restarts
+// the machine's daemon, so this is off unless asked for.
+func AutoRegenerateCerts(autoRegenerateCerts bool) Option {
+	return func(o *options) {
+		o.autoRegenerateCerts = autoRegenerateCerts
+	}
+}
+
+// Read the machine's config.json from the machine store rather than
+// running `docker-machine`, falling back onto the binary when the store
+// can't be found or parsed.
+func WithStorageSource() Option {
+	return func(o *options) {
+		o.configSource = (*options).configFromStorage
+	}
+}
+
+// Read the machine's details from the JSON `docker-machine inspect`
+// prints instead of `docker-machine config`, falling back onto the
+// latter for versions whose inspect output can't be used.
+func WithInspectSource() Option {
+	return func(o *options) {
+		o.configSource = (*options).configFromInspectCommand
+	}
+}
+
+// Ask for the daemon's API version at the given path instead of
+// /version, for daemons mounted under a prefix by a reverse proxy, such
+// as /docker/version. An empty path keeps the default.
+func WithVersionPath(path string) Option {
+	return func(o *options) {
+		if path != "" {
+			o.versionPath = path
+		}
+	}
+}
+
+// Call the hook at the end of each stage of building a client, such as
+// StageSubprocess or StageProbe, for metrics or tracing.
+func WithStageHook(onStage StageHook) Option {
+	return func(o *options) {
+		o.onStage = onStage
+	}
+}
+
+// Record how long the subprocess and the probe take to the given sink.
+// A nil sink records nothing.
+func WithMetrics(metrics Metrics) Option {
+	return func(o *options) {
+		o.metrics = metrics
+	}
+}
+
+// Use the given PEM encoded CA cert, client cert and key instead of
+// reading the files docker-machine reports, for certs injected as
+// secrets rather than written to disk. The files are not read at all.
+func WithCertBytes(caCert, cert, key []byte) Option {
+	return func(o *options) {
+		o.certBytes = &certBytes{caCert: caCert, cert: cert, key: key}
+	}
+}
+
+// Take the client cert and key from the PKCS#12 bundle at the given
+// path, as some secret stores hand them out, instead of the machine's
+// PEM files. The machine's CA cert is still used, so machines without
+// TLS ignore the bundle. WithCertBytes, if also given, wins.
+func WithPKCS12(path, password string) Option {
+	return func(o *options) {
+		o.pkcs12 = &pkcs12Bundle{path: path, password: password}
+	}
+}
+
+// Return the `docker-machine` error instead of falling back, even from
+// functions that bring their own supplier such as
+// GetDockerClientEnvFallback, for environments where docker-machine is
+// the only supported way in.
+func WithFallbackDisabled(disabled bool) Option {
+	return func(o *options) {
+		o.fallbackDisabled = disabled
+	}
+}
+
+// Let the docker client negotiate the API version over its own ping
+// instead of the package asking /version itself, so auth, proxies and
+// sockets are handled exactly as the client handles them. The version
+// never exceeds the library's own, and WithVersionPath has no effect.
+// A version given to WithAPIVersion still wins.
+func WithClientNegotiation() Option {
+	return func(o *options) {
+		o.clientNegotiation = true
+	}
+}
+
+// Send the given headers, such as a routing token a corporate proxy
+// needs, on every request to the daemon, including the one asking for
+// its API version. Later calls add to, and override, earlier ones.
+func WithHTTPHeaders(headers map[string]string) Option {
+	return func(o *options) {
+		if o.httpHeaders == nil {
+			o.httpHeaders = map[string]string{}
+		}
+		for key, value := range headers {
+			o.httpHeaders[key] = value
+		}
+	}
+}
+
+// Identify the package to the daemon, and any gateway in front of it,
+// by the given User-Agent on every request, including the one asking
+// for its API version. An empty value keeps Go's own.
+func WithUserAgent(userAgent string) Option {
+	return func(o *options) {
+		if userAgent == "" {
+			delete(o.httpHeaders, "User-Agent")
+			return
+		}
+		WithHTTPHeaders(map[string]string{"User-Agent": userAgent})(o)
+	}
+}
+
+// Use the machine store at the given path instead of ~/.docker/machine,
+// for CI jobs that each have their own store. It's passed to
+// `docker-machine` as MACHINE_STORAGE_PATH, leaving the process's own
+// environment alone. An empty path keeps the default.
+func WithStoragePath(path string) Option {
+	return func(o *options) {
+		o.storagePath = path
+	}
+}
+
+// Use the machine store of a rootless setup, under XDG_CONFIG_HOME,
+// both for docker-machine and for resolving cert paths. Without it the
+// rootless store is still used when it's the only one there is, and a
+// path given to WithStoragePath wins either way.
+func WithRootless() Option {
+	return func(o *options) {
+		o.rootless = true
+	}
+}
+
+// Tunnel to the daemon over SSH, with the user, port and key
+// `docker-machine inspect` reports, when it can't be reached directly,
+// for machines behind NAT. It needs the ssh binary on the PATH, and the
+// machine's address must accept SSH. A tunnel costs an ssh process per
+// connection, so this is off unless asked for.
+func WithSSHTunnel() Option {
+	return func(o *options) {
+		o.sshTunnel = true
+	}
+}
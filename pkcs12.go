@@ -0,0 +1,86 @@
+package docker_machine_helper
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/pkcs12"
+	"io/ioutil"
+)
+
+// A bundle given to WithPKCS12 in place of the machine's client cert
+// and key files.
+type pkcs12Bundle struct {
+	path     string
+	password string
+}
+
+// Trusts the machine's CA cert as usual, but takes the client cert and
+// key from the bundle. Any further certs in it are presented as the
+// client cert's chain.
+func (o *options) loadPKCS12Certs(caCertFilePath string) (*tls.Config, error) {
+	if caCertFilePath == "" {
+		return nil, fmt.Errorf("no CA cert reported to trust alongside PKCS#12 bundle %s", o.pkcs12.path)
+	}
+	caCertPEM, err := readCACertFiles(caCertFilePath)
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := ioutil.ReadFile(o.pkcs12.path)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#12 bundle %s is unreadable: %w", o.pkcs12.path, err)
+	}
+	blocks, err := pkcs12.ToPEM(bundle, o.pkcs12.password)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode PKCS#12 bundle %s: %w", o.pkcs12.path, err)
+	}
+	certs, keys := []*pem.Block{}, []*pem.Block{}
+	for _, block := range blocks {
+		if block.Type == "CERTIFICATE" {
+			certs = append(certs, block)
+		} else {
+			keys = append(keys, block)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("PKCS#12 bundle %s has no private key", o.pkcs12.path)
+	}
+	certPEM, keyPEM := []byte{}, []byte{}
+	for _, block := range leafFirst(certs, keys[0]) {
+		certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+	}
+	for _, block := range keys {
+		keyPEM = append(keyPEM, pem.EncodeToMemory(block)...)
+	}
+	return o.buildTLSConfig(caCertFilePath, o.pkcs12.path, caCertPEM, certPEM, keyPEM)
+}
+
+// tls.X509KeyPair takes the first cert to be the key's, but bundles
+// keep to no order, often putting the CA first. The leaf is the cert
+// sharing the key's localKeyId or, without one, the cert the key fits.
+// The rest keep their order.
+func leafFirst(certs []*pem.Block, key *pem.Block) []*pem.Block {
+	leaf := -1
+	if id := key.Headers["localKeyId"]; id != "" {
+		for i, cert := range certs {
+			if cert.Headers["localKeyId"] == id {
+				leaf = i
+				break
+			}
+		}
+	}
+	if leaf < 0 {
+		keyPEM := pem.EncodeToMemory(key)
+		for i, cert := range certs {
+			if _, err := tls.X509KeyPair(pem.EncodeToMemory(cert), keyPEM); err == nil {
+				leaf = i
+				break
+			}
+		}
+	}
+	if leaf <= 0 {
+		return certs
+	}
+	ordered := append([]*pem.Block{certs[leaf]}, certs[:leaf]...)
+	return append(ordered, certs[leaf+1:]...)
+}
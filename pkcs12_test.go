@@ -0,0 +1,86 @@
+package docker_machine_helper
+
+import (
+	"encoding/pem"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLeafFirst(t *testing.T) {
+	pki := newTestPKI(t)
+	ca, _ := pem.Decode(pki.caPEM)
+	leaf, _ := pem.Decode(pki.clientCertPEM)
+	key, _ := pem.Decode(pki.clientKeyPEM)
+
+	// Told apart by the key alone
+	ordered := leafFirst([]*pem.Block{ca, leaf}, key)
+	if len(ordered) != 2 || ordered[0] != leaf || ordered[1] != ca {
+		t.Errorf("expected the cert the key fits to come first")
+	}
+
+	// The localKeyId wins, as openssl writes it
+	withID := func(block *pem.Block, id string) *pem.Block {
+		return &pem.Block{Type: block.Type, Headers: map[string]string{"localKeyId": id}, Bytes: block.Bytes}
+	}
+	caWithID, leafWithID := withID(ca, "02"), withID(leaf, "01")
+	ordered = leafFirst([]*pem.Block{caWithID, leafWithID}, withID(key, "01"))
+	if ordered[0] != leafWithID || ordered[1] != caWithID {
+		t.Errorf("expected the cert sharing the key's localKeyId to come first")
+	}
+
+	// Nothing fits, so X509KeyPair is left to say so
+	other, _ := pem.Decode(newTestPKI(t).clientKeyPEM)
+	ordered = leafFirst([]*pem.Block{ca, leaf}, other)
+	if ordered[0] != ca || ordered[1] != leaf {
+		t.Errorf("expected the order to be kept when no cert fits the key")
+	}
+}
+
+func TestPKCS12Bundle(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("no openssl to write the bundle")
+	}
+	pki := newTestPKI(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	pki.writeCerts(t, dir)
+	bundle := filepath.Join(dir, "client.p12")
+	// -legacy for the ciphers x/crypto/pkcs12 can decode
+	output, err := exec.Command(openssl, "pkcs12", "-export", "-legacy",
+		"-in", filepath.Join(dir, "cert.pem"),
+		"-inkey", filepath.Join(dir, "key.pem"),
+		"-certfile", filepath.Join(dir, "ca.pem"),
+		"-out", bundle, "-passout", "pass:secret").CombinedOutput()
+	if err != nil {
+		t.Skipf("openssl could not write a legacy bundle: %s", output)
+	}
+	server := pki.tlsServer(versionHandler("1.40"))
+	defer server.Close()
+	// Only the CA cert is taken from the machine
+	config := tlsMachineConfig(dir, server)
+	config.TLSCert, config.TLSKey = "/nonexistent/cert.pem", "/nonexistent/key.pem"
+
+	_, err = NewClientFromConfig(config, quietLogger, WithPKCS12(bundle, "secret"))
+	mustNotError(t, err)
+
+	_, err = NewClientFromConfig(config, quietLogger, WithPKCS12(bundle, "wrong"))
+	if err == nil || !strings.Contains(err.Error(), "could not decode PKCS#12 bundle") {
+		t.Errorf("expected a wrong password to be reported, got %v", err)
+	}
+
+	config.TLSCaCert = ""
+	_, err = NewClientFromConfig(config, quietLogger, WithPKCS12(bundle, "secret"))
+	if err == nil || !strings.Contains(err.Error(), "no CA cert reported") {
+		t.Errorf("expected a missing CA cert to be reported, got %v", err)
+	}
+
+	// A machine without TLS is spoken to over plain http regardless
+	plain := httptest.NewServer(versionHandler("1.40"))
+	defer plain.Close()
+	_, err = NewClientFromConfig(DockerMachineConfig{URL: "tcp://" + plain.Listener.Addr().String()}, quietLogger, WithPKCS12(bundle, "secret"))
+	mustNotError(t, err)
+}
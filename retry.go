@@ -0,0 +1,46 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Runs the operation until it succeeds, fails in a way retrying won't
+// fix, or runs out of the attempts given to WithRetry. The delay between
+// attempts doubles each time, and waiting stops early if the context is
+// done. Without WithRetry the operation runs exactly once.
+func (o *options) retry(ctx context.Context, operation func() error) error {
+	delay := o.retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil || attempt >= o.retryAttempts || !isRetryable(err) {
+			return err
+		}
+		o.logger.Printf("Attempt %d of %d failed, retrying in %s: %s", attempt, o.retryAttempts, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// A machine that doesn't exist, or a binary that isn't installed, won't
+// appear by trying again, and neither will an active machine, matching
+// certs or a cancelled context.
+func isRetryable(err error) bool {
+	switch {
+	case errors.Is(err, ErrDockerMachineNotInstalled),
+		errors.Is(err, ErrMachineNotFound),
+		isNoActiveMachine(err),
+		errors.Is(err, ErrTLSHandshake),
+		errors.Is(err, context.Canceled):
+		return false
+	}
+	return !strings.Contains(err.Error(), "does not exist")
+}
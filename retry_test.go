@@ -0,0 +1,76 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fails `docker-machine config` with the error until it has been run
+// the given number of times, counting every run.
+func failingTimes(failures int, err error, runs *int) cannedRunner {
+	config := configRunner("-H=tcp://192.168.99.100:2376")
+	return func(args []string) ([]string, error) {
+		if args[0] != "config" {
+			return config(args)
+		}
+		*runs++
+		if *runs <= failures {
+			return nil, err
+		}
+		return config(args)
+	}
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	runs := 0
+	defer withCommandRunner(failingTimes(2, errors.New("exit status 1: Error checking TLS connection: connection refused"), &runs))()
+	config, err := ResolveConfig("dev", quietLogger, WithRetry(3, time.Millisecond))
+	mustNotError(t, err)
+	if runs != 3 || config.URL != "tcp://192.168.99.100:2376" {
+		t.Errorf("expected success on the third run, got %d runs and %+v", runs, config)
+	}
+}
+
+func TestRetryAttemptLimit(t *testing.T) {
+	runs := 0
+	defer withCommandRunner(failingTimes(10, errors.New("exit status 1: Error checking TLS connection: connection refused"), &runs))()
+	_, err := ResolveConfig("dev", quietLogger, WithRetry(3, time.Millisecond))
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("expected the last failure, got %v", err)
+	}
+	if runs != 3 {
+		t.Errorf("expected 3 runs, got %d", runs)
+	}
+}
+
+func TestRetryStopsForMissingHost(t *testing.T) {
+	runs := 0
+	defer withCommandRunner(failingTimes(10, errors.New(`exit status 1: Host does not exist: "dev"`), &runs))()
+	_, err := ResolveConfig("dev", quietLogger, WithRetry(3, time.Millisecond))
+	if err == nil || runs != 1 {
+		t.Errorf("expected a missing host to fail straight away, got %d runs and %v", runs, err)
+	}
+}
+
+func TestRetryStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runs := 0
+	failing := failingTimes(10, errors.New("exit status 1: Error checking TLS connection: connection refused"), &runs)
+	defer withCommandRunner(func(args []string) ([]string, error) {
+		// Cancelled just as the backoff starts
+		cancel()
+		return failing(args)
+	})()
+	start := time.Now()
+	_, err := NewClientFactory(quietLogger, WithMachineName("dev"), WithRetry(3, time.Hour)).Client(ctx)
+	if err == nil || runs != 1 {
+		t.Errorf("expected no further runs once cancelled, got %d runs and %v", runs, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the backoff to be cut short, took %s", elapsed)
+	}
+}
@@ -0,0 +1,181 @@
+package docker_machine_helper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/client"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How a machine is reached over SSH, from `docker-machine inspect`.
+type sshTarget struct {
+	user    string
+	host    string
+	port    int
+	keyPath string
+}
+
+// Tries again over an SSH tunnel once the daemon couldn't be reached
+// directly. The tunnel runs the system's ssh with -W, so the request
+// still reaches the daemon's tcp port, only from the machine's end, and
+// its TLS is verified exactly as before.
+func (o *options) clientOverSSHTunnel(ctx context.Context, machineName string, dockerMachineConfig DockerMachineConfig, directErr error) (*client.Client, error) {
+	target, err := o.sshTargetOf(ctx, machineName)
+	if err != nil {
+		return nil, fmt.Errorf("%w, and no SSH tunnel could be set up: %s", directErr, err)
+	}
+	hostURL, err := url.Parse(dockerMachineConfig.URL)
+	if err != nil || hostURL.Port() == "" {
+		return nil, fmt.Errorf("%w, and no SSH tunnel could be set up: no port in %q", directErr, dockerMachineConfig.URL)
+	}
+	o.logger.Printf("Could not reach %s directly, tunnelling over SSH to %s: %s", describeMachine(machineName), target.host, directErr)
+	dial := target.dialer(net.JoinHostPort("localhost", hostURL.Port()))
+	// The tunnel's transport is always a new one, so a failed attempt
+	// closes its connections, and with them the ssh processes
+	tunnelled := *o
+	tunnelled.ownsHTTPClient = true
+	if o.httpClient != nil {
+		httpClient := *o.httpClient
+		transport, ok := httpClient.Transport.(*http.Transport)
+		if !ok {
+			transport = &http.Transport{}
+		}
+		transport = transport.Clone()
+		transport.DialContext = dial
+		httpClient.Transport = transport
+		tunnelled.httpClient = &httpClient
+	} else {
+		tunnelled.httpClient = &http.Client{Transport: &http.Transport{
+			DialContext:         dial,
+			MaxIdleConnsPerHost: o.maxIdleConnsPerHost,
+			IdleConnTimeout:     o.idleConnTimeout,
+		}}
+	}
+	return tunnelled.newClientFromConfig(ctx, machineName, dockerMachineConfig)
+}
+
+func (o *options) sshTargetOf(ctx context.Context, machineName string) (sshTarget, error) {
+	inspection, err := o.inspect(ctx, machineName)
+	if err != nil {
+		return sshTarget{}, err
+	}
+	driver := inspection.Driver
+	if driver.IPAddress == "" || driver.SSHUser == "" {
+		return sshTarget{}, fmt.Errorf("machine %q has no SSH details", inspection.Name)
+	}
+	port := driver.SSHPort
+	if port == 0 {
+		port = 22
+	}
+	return sshTarget{user: driver.SSHUser, host: driver.IPAddress, port: port, keyPath: driver.SSHKeyPath}, nil
+}
+
+// Each connection is its own ssh process forwarding stdin and stdout to
+// the address as seen from the machine. The options are the ones
+// docker-machine itself uses, as machines get a new host key each time
+// they're created.
+func (t sshTarget) dialer(address string) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		args := []string{
+			"-o", "BatchMode=yes",
+			"-o", "StrictHostKeyChecking=no",
+			"-o", "UserKnownHostsFile=/dev/null",
+			"-o", "LogLevel=quiet",
+			"-p", strconv.Itoa(t.port),
+			"-W", address,
+		}
+		if t.keyPath != "" {
+			args = append(args, "-o", "IdentitiesOnly=yes", "-i", t.keyPath)
+		}
+		args = append(args, t.user+"@"+t.host)
+		// Not tied to ctx, which only covers dialing, while the process
+		// has to outlive it for as long as the connection is in use
+		command := exec.Command("ssh", args...)
+		conn := &sshConn{command: command, address: address}
+		command.Stderr = &conn.stderr
+		stdin, err := command.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := command.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		conn.stdin, conn.stdout = stdin, stdout
+		if err := command.Start(); err != nil {
+			return nil, fmt.Errorf("could not start ssh: %w", err)
+		}
+		return conn, nil
+	}
+}
+
+// A connection over an ssh process's stdin and stdout. Deadlines aren't
+// supported, so timeouts come from contexts alone.
+type sshConn struct {
+	command *exec.Cmd
+	address string
+	stdin   io.WriteCloser
+	stdout  io.ReadCloser
+	stderr  lockedBuffer
+}
+
+func (c *sshConn) Read(b []byte) (int, error) {
+	n, err := c.stdout.Read(b)
+	// ssh explains a failed tunnel on stderr and merely exits
+	if message := c.stderr.String(); errors.Is(err, io.EOF) && message != "" {
+		return n, fmt.Errorf("ssh tunnel to %s closed: %s", c.address, strings.TrimSpace(message))
+	}
+	return n, err
+}
+
+func (c *sshConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+func (c *sshConn) Close() error {
+	c.stdin.Close()
+	if c.command.Process != nil {
+		c.command.Process.Kill()
+	}
+	c.command.Wait()
+	return nil
+}
+
+func (c *sshConn) LocalAddr() net.Addr                { return sshAddr("local") }
+func (c *sshConn) RemoteAddr() net.Addr               { return sshAddr(c.address) }
+func (c *sshConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sshConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sshConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// The process writes stderr from its own goroutine while Read looks.
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+type sshAddr string
+
+func (a sshAddr) Network() string { return "ssh" }
+func (a sshAddr) String() string  { return string(a) }
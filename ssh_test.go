@@ -0,0 +1,142 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Puts an ssh on the PATH that, instead of logging in anywhere, relays
+// stdin and stdout to the -W port on this host. It records its
+// arguments and pid, one run per line, in ssh.log next to it.
+func withFakeSSH(t *testing.T) (string, func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ssh is a shell script")
+	}
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("no bash for the fake ssh")
+	}
+	dir, cleanup := tempDir(t)
+	script := filepath.Join(dir, "ssh")
+	writeFile(t, script, []byte(`#!`+bash+`
+while [ $# -gt 0 ]; do
+	case "$1" in -W) address="$2" ;; esac
+	all="$all $1"
+	shift
+done
+echo "$$$all" >> "`+filepath.Join(dir, "ssh.log")+`"
+exec 3<>"/dev/tcp/127.0.0.1/${address##*:}"
+# Kept off stderr, which the caller waits on until every holder exits
+cat <&3 2>/dev/null &
+cat >&3
+`))
+	mustNotError(t, os.Chmod(script, 0755))
+	restore := setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return filepath.Join(dir, "ssh.log"), func() {
+		restore()
+		cleanup()
+	}
+}
+
+// A machine whose daemon's port is closed from here, but open from the
+// machine's end, where the fake ssh connects to the server.
+func unreachableMachine(server *httptest.Server) cannedRunner {
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	return func(args []string) ([]string, error) {
+		switch args[0] {
+		case "config":
+			return []string{"-H=tcp://127.0.0.2:" + port}, nil
+		case "inspect":
+			if args[1] == "--format" {
+				return []string{"virtualbox"}, nil
+			}
+			return strings.Split(sampleInspection, "\n"), nil
+		}
+		return configRunner()(args)
+	}
+}
+
+func sshRuns(t *testing.T, log string) []string {
+	contents, err := ioutil.ReadFile(log)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	mustNotError(t, err)
+	return strings.Split(strings.TrimSpace(string(contents)), "\n")
+}
+
+func TestSSHTunnel(t *testing.T) {
+	log, cleanup := withFakeSSH(t)
+	defer cleanup()
+	server := httptest.NewServer(versionHandler("1.40"))
+	defer server.Close()
+	defer withCommandRunner(unreachableMachine(server))()
+
+	// Without the option the dial failure stands
+	_, err := NewClientFactory(quietLogger, WithMachineName("dev")).Client(context.Background())
+	if !isDialError(err) || len(sshRuns(t, log)) != 0 {
+		t.Fatalf("expected a dial failure and no tunnel, got %v", err)
+	}
+
+	dockerClient, err := NewClientFactory(quietLogger, WithMachineName("dev"), WithSSHTunnel()).Client(context.Background())
+	mustNotError(t, err)
+	_, err = dockerClient.Ping(context.Background())
+	mustNotError(t, err)
+	dockerClient.Close()
+	runs := sshRuns(t, log)
+	if len(runs) == 0 {
+		t.Fatalf("expected the tunnel to be used")
+	}
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	for _, expected := range []string{"-p 50022", "-W localhost:" + port, "-i /home/dev/.docker/machine/machines/dev/id_rsa", "docker@192.168.99.100"} {
+		if !strings.Contains(runs[0], expected) {
+			t.Errorf("expected %q in the ssh arguments, got %q", expected, runs[0])
+		}
+	}
+}
+
+func TestFailedSSHTunnelClosesProcesses(t *testing.T) {
+	log, cleanup := withFakeSSH(t)
+	defer cleanup()
+	// Answers in full, keeping the connection reusable, but not with a
+	// version
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	}))
+	defer server.Close()
+	defer withCommandRunner(unreachableMachine(server))()
+
+	_, err := NewClientFactory(quietLogger, WithMachineName("dev"), WithSSHTunnel()).Client(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "could not determine ApiVersion") {
+		t.Fatalf("expected the tunnelled probe to fail, got %v", err)
+	}
+	runs := sshRuns(t, log)
+	if len(runs) == 0 {
+		t.Fatalf("expected the tunnel to be used")
+	}
+	for _, run := range runs {
+		pid, err := strconv.Atoi(strings.Fields(run)[0])
+		mustNotError(t, err)
+		process, err := os.FindProcess(pid)
+		mustNotError(t, err)
+		deadline := time.Now().Add(2 * time.Second)
+		for process.Signal(syscall.Signal(0)) == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if process.Signal(syscall.Signal(0)) == nil {
+			t.Errorf("expected ssh process %d to be gone", pid)
+		}
+	}
+}
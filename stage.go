@@ -0,0 +1,54 @@
+package docker_machine_helper
+
+import (
+	"time"
+)
+
+// The stages of building a client, as reported to WithStageHook.
+const (
+	// One run of the `docker-machine` binary.
+	StageSubprocess = "subprocess"
+	// Resolving the machine's config, including any subprocess and
+	// parsing its output.
+	StageConfig = "config"
+	// Loading the certs into a TLS config.
+	StageCerts = "certs"
+	// Asking the daemon for its API version. Skipped, and so not
+	// reported, when the version is pinned.
+	StageProbe = "probe"
+	// Constructing the docker client itself.
+	StageClient = "client"
+)
+
+// Called once each stage is over, with how long it took and the error
+// it failed with, if any.
+type StageHook func(stage string, elapsed time.Duration, err error)
+
+// Receives the durations of the stages worth tracking against an SLO,
+// for wiring into Prometheus or the like without this package
+// depending on it. Failed stages are observed too.
+type Metrics interface {
+	// How long one run of the `docker-machine` binary took.
+	ObserveSubprocess(elapsed time.Duration)
+	// How long asking the daemon for its API version took, retries
+	// included.
+	ObserveProbe(elapsed time.Duration)
+}
+
+// Reports the stage that started at the given time. Meant to be
+// deferred, hence the pointer to the error the stage will end with.
+func (o *options) observeStage(stage string, start time.Time, err *error) {
+	elapsed := time.Since(start)
+	if o.onStage != nil {
+		o.onStage(stage, elapsed, *err)
+	}
+	if o.metrics == nil {
+		return
+	}
+	switch stage {
+	case StageSubprocess:
+		o.metrics.ObserveSubprocess(elapsed)
+	case StageProbe:
+		o.metrics.ObserveProbe(elapsed)
+	}
+}
@@ -0,0 +1,80 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingMetrics struct {
+	mutex      sync.Mutex
+	subprocess []time.Duration
+	probe      []time.Duration
+}
+
+func (m *recordingMetrics) ObserveSubprocess(elapsed time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.subprocess = append(m.subprocess, elapsed)
+}
+
+func (m *recordingMetrics) ObserveProbe(elapsed time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.probe = append(m.probe, elapsed)
+}
+
+func TestMetrics(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	daemon := versionHandler("1.40")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		daemon.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	config := configRunner("-H=tcp://" + server.Listener.Addr().String())
+	defer withCommandRunner(func(args []string) ([]string, error) {
+		time.Sleep(delay)
+		return config(args)
+	})()
+	metrics := &recordingMetrics{}
+	stages := []string{}
+	hook := func(stage string, elapsed time.Duration, err error) {
+		stages = append(stages, stage)
+	}
+	_, err := NewClientFactory(quietLogger, WithMachineName("dev"), WithMetrics(metrics), WithStageHook(hook)).Client(context.Background())
+	mustNotError(t, err)
+
+	// config, then inspect for the driver
+	if len(metrics.subprocess) != 2 {
+		t.Fatalf("expected two subprocesses, got %v", metrics.subprocess)
+	}
+	for _, elapsed := range append(metrics.subprocess, metrics.probe...) {
+		if elapsed < delay || elapsed > 5*time.Second {
+			t.Errorf("implausible duration %s", elapsed)
+		}
+	}
+	if len(metrics.probe) != 1 {
+		t.Errorf("expected one probe, got %v", metrics.probe)
+	}
+	expected := []string{StageSubprocess, StageSubprocess, StageConfig, StageProbe, StageClient}
+	if len(stages) != len(expected) {
+		t.Fatalf("expected stages %q, got %q", expected, stages)
+	}
+	for i, stage := range expected {
+		if stages[i] != stage {
+			t.Errorf("expected stages %q, got %q", expected, stages)
+			break
+		}
+	}
+}
+
+func TestNoMetrics(t *testing.T) {
+	defer withCommandRunner(configRunner("-H=tcp://192.168.99.100:2376"))()
+	// Nothing to observe with, which mustn't matter
+	_, err := ResolveConfig("dev", quietLogger)
+	mustNotError(t, err)
+}
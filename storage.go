@@ -0,0 +1,168 @@
+package docker_machine_helper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Where docker-machine keeps its machines and certs: MACHINE_STORAGE_PATH
+// if set, otherwise ~/.docker/machine, unless only a rootless setup's
+// store under XDG_CONFIG_HOME exists.
+func machineStoragePath() string {
+	if storagePath := os.Getenv("MACHINE_STORAGE_PATH"); storagePath != "" {
+		return storagePath
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	storagePath := filepath.Join(home, ".docker", "machine")
+	if _, err := os.Stat(storagePath); err != nil {
+		if xdgPath := xdgStoragePath(); xdgPath != "" {
+			if _, err := os.Stat(xdgPath); err == nil {
+				return xdgPath
+			}
+		}
+	}
+	return storagePath
+}
+
+// The store of a rootless setup, which follows the XDG base directory
+// conventions: $XDG_CONFIG_HOME/docker/machine, XDG_CONFIG_HOME being
+// ~/.config when unset.
+func xdgStoragePath() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "docker", "machine")
+}
+
+// The store given to WithStoragePath, or the rootless one if
+// WithRootless was asked for, or else the one docker-machine itself
+// would use.
+func (o *options) machineStoragePath() string {
+	switch {
+	case o.storagePath != "":
+		return o.storagePath
+	case o.rootless:
+		return xdgStoragePath()
+	}
+	return machineStoragePath()
+}
+
+// Anchors relative cert paths to the storage path, since they are
+// relative to docker-machine's store rather than our working directory.
+// Absolute paths are left as they are.
+func resolveCertPaths(config DockerMachineConfig, storagePath string) DockerMachineConfig {
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) || storagePath == "" {
+			return path
+		}
+		return filepath.Join(storagePath, path)
+	}
+	config.TLSCaCert = resolve(config.TLSCaCert)
+	config.TLSCert = resolve(config.TLSCert)
+	config.TLSKey = resolve(config.TLSKey)
+	return config
+}
+
+// The parts of a machine's config.json we need, which is also what
+// `docker-machine inspect` prints.
+type machineInspection struct {
+	Name       string
+	DriverName string
+	Driver     struct {
+		IPAddress  string
+		EnginePort int
+		SSHUser    string
+		SSHPort    int
+		SSHKeyPath string
+	}
+	HostOptions struct {
+		EngineOptions struct {
+			TlsVerify bool
+		}
+		AuthOptions struct {
+			CaCertPath     string
+			ClientCertPath string
+			ClientKeyPath  string
+		}
+	}
+}
+
+// The port docker-machine has the engine listen on unless the driver
+// says otherwise.
+const defaultEnginePort = 2376
+
+// TLS is used as the machine's engine options say, so a machine created
+// without TLS verification is spoken to over plain http, as
+// `docker-machine config` would have it.
+func configFromMachineInspection(inspection machineInspection) (DockerMachineConfig, error) {
+	if inspection.Driver.IPAddress == "" {
+		return DockerMachineConfig{}, fmt.Errorf("machine %q has no IP address", inspection.Name)
+	}
+	port := inspection.Driver.EnginePort
+	if port == 0 {
+		port = defaultEnginePort
+	}
+	authOptions := inspection.HostOptions.AuthOptions
+	return DockerMachineConfig{
+		URL:       "tcp://" + net.JoinHostPort(inspection.Driver.IPAddress, strconv.Itoa(port)),
+		TLSVerify: inspection.HostOptions.EngineOptions.TlsVerify,
+		TLSCaCert: authOptions.CaCertPath,
+		TLSCert:   authOptions.ClientCertPath,
+		TLSKey:    authOptions.ClientKeyPath,
+		Driver:    inspection.DriverName,
+	}, nil
+}
+
+// A config source reading the machine's config.json straight from the
+// store, for sandboxes where running subprocesses is slow or forbidden.
+// If the store can't be found or parsed it falls back onto
+// `docker-machine config`.
+func (o *options) configFromStorage(ctx context.Context, machineName string) (DockerMachineConfig, error) {
+	config, err := readMachineConfig(o.machineStoragePath(), storedMachineName(machineName))
+	if err != nil {
+		o.logger.Printf("Could not read %s from the machine store, asking docker-machine: %s", describeMachine(machineName), err)
+		return o.configFromConfigCommand(ctx, machineName)
+	}
+	return config, nil
+}
+
+// docker-machine falls back onto the machine named "default" when none
+// is given, unless a shell has been pointed at another one.
+func storedMachineName(machineName string) string {
+	if machineName != "" {
+		return machineName
+	}
+	if active := os.Getenv("DOCKER_MACHINE_NAME"); active != "" {
+		return active
+	}
+	return "default"
+}
+
+func readMachineConfig(storagePath, machineName string) (DockerMachineConfig, error) {
+	if storagePath == "" {
+		return DockerMachineConfig{}, fmt.Errorf("no machine store found")
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(storagePath, "machines", machineName, "config.json"))
+	if err != nil {
+		return DockerMachineConfig{}, err
+	}
+	inspection := machineInspection{}
+	if err := json.Unmarshal(contents, &inspection); err != nil {
+		return DockerMachineConfig{}, fmt.Errorf("could not parse config of machine %q: %w", machineName, err)
+	}
+	return configFromMachineInspection(inspection)
+}
@@ -0,0 +1,141 @@
+package docker_machine_helper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestResolveCertPaths(t *testing.T) {
+	storagePath := filepath.FromSlash("/home/dev/.docker/machine")
+	absolute, err := filepath.Abs("ca.pem")
+	mustNotError(t, err)
+	config := resolveCertPaths(DockerMachineConfig{
+		TLSCaCert: absolute,
+		TLSCert:   filepath.FromSlash("machines/dev/cert.pem"),
+		TLSKey:    "key.pem",
+	}, storagePath)
+	if config.TLSCaCert != absolute {
+		t.Errorf("expected the absolute path to be kept, got %q", config.TLSCaCert)
+	}
+	if expected := filepath.Join(storagePath, "machines", "dev", "cert.pem"); config.TLSCert != expected {
+		t.Errorf("expected %q, got %q", expected, config.TLSCert)
+	}
+	if expected := filepath.Join(storagePath, "key.pem"); config.TLSKey != expected {
+		t.Errorf("expected %q, got %q", expected, config.TLSKey)
+	}
+}
+
+func TestResolveCertPathsWithoutStore(t *testing.T) {
+	config := resolveCertPaths(DockerMachineConfig{TLSCert: "cert.pem"}, "")
+	if config.TLSCert != "cert.pem" {
+		t.Errorf("expected the path to be left alone, got %q", config.TLSCert)
+	}
+	if config = resolveCertPaths(DockerMachineConfig{}, "/store"); config.TLSCaCert != "" {
+		t.Errorf("expected an empty path to stay empty, got %q", config.TLSCaCert)
+	}
+}
+
+func TestConfigCommandResolvesRelativeCerts(t *testing.T) {
+	defer withCommandRunner(configRunner(
+		`--tlsverify`,
+		`--tlscacert="certs/ca.pem"`,
+		`--tlscert="machines/dev/cert.pem"`,
+		`--tlskey="machines/dev/key.pem"`,
+		`-H=tcp://192.168.99.100:2376`,
+	))()
+	storagePath := filepath.FromSlash("/var/lib/machine")
+	config, err := ResolveConfig("dev", quietLogger, WithStoragePath(storagePath))
+	mustNotError(t, err)
+	if expected := filepath.Join(storagePath, "certs", "ca.pem"); config.TLSCaCert != expected {
+		t.Errorf("expected %q, got %q", expected, config.TLSCaCert)
+	}
+	if expected := filepath.Join(storagePath, "machines", "dev", "key.pem"); config.TLSKey != expected {
+		t.Errorf("expected %q, got %q", expected, config.TLSKey)
+	}
+}
+
+func TestStoredConfigTLSVerify(t *testing.T) {
+	for _, verify := range []bool{true, false} {
+		storagePath, cleanup := tempDir(t)
+		defer cleanup()
+		machineDir := filepath.Join(storagePath, "machines", "dev")
+		mustNotError(t, os.MkdirAll(machineDir, 0700))
+		writeFile(t, filepath.Join(machineDir, "config.json"), []byte(fmt.Sprintf(`{
+			"Name": "dev",
+			"DriverName": "virtualbox",
+			"Driver": {"IPAddress": "192.168.99.100"},
+			"HostOptions": {
+				"EngineOptions": {"TlsVerify": %t},
+				"AuthOptions": {"CaCertPath": "/certs/ca.pem"}
+			}
+		}`, verify)))
+		config, err := readMachineConfig(storagePath, "dev")
+		mustNotError(t, err)
+		if config.TLSVerify != verify {
+			t.Errorf("expected TLSVerify %t from the engine options", verify)
+		}
+		if config.URL != "tcp://192.168.99.100:2376" || config.Driver != "virtualbox" {
+			t.Errorf("unexpected config %+v", config)
+		}
+	}
+}
+
+func TestXDGStoragePath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the home directory doesn't come from HOME")
+	}
+	home, cleanup := tempDir(t)
+	defer cleanup()
+	defer setenv("HOME", home)()
+	defer setenv("MACHINE_STORAGE_PATH", "")()
+	defer setenv("XDG_CONFIG_HOME", "")()
+	defaultPath := filepath.Join(home, ".docker", "machine")
+	xdgPath := filepath.Join(home, ".config", "docker", "machine")
+
+	if path := xdgStoragePath(); path != xdgPath {
+		t.Errorf("expected %q without XDG_CONFIG_HOME, got %q", xdgPath, path)
+	}
+	if path := machineStoragePath(); path != defaultPath {
+		t.Errorf("expected %q when no store exists, got %q", defaultPath, path)
+	}
+	mustNotError(t, os.MkdirAll(xdgPath, 0700))
+	if path := machineStoragePath(); path != xdgPath {
+		t.Errorf("expected the only existing store %q, got %q", xdgPath, path)
+	}
+	mustNotError(t, os.MkdirAll(defaultPath, 0700))
+	if path := machineStoragePath(); path != defaultPath {
+		t.Errorf("expected docker-machine's own store %q to win, got %q", defaultPath, path)
+	}
+
+	configHome := filepath.Join(home, "xdg")
+	os.Setenv("XDG_CONFIG_HOME", configHome)
+	if path := xdgStoragePath(); path != filepath.Join(configHome, "docker", "machine") {
+		t.Errorf("expected the store under XDG_CONFIG_HOME, got %q", path)
+	}
+	os.Setenv("MACHINE_STORAGE_PATH", "/explicit")
+	if path := machineStoragePath(); path != "/explicit" {
+		t.Errorf("expected MACHINE_STORAGE_PATH to win, got %q", path)
+	}
+}
+
+func TestRootlessStoragePath(t *testing.T) {
+	configHome, cleanup := tempDir(t)
+	defer cleanup()
+	defer setenv("XDG_CONFIG_HOME", configHome)()
+	xdgPath := filepath.Join(configHome, "docker", "machine")
+
+	o := newOptions([]Option{WithRootless()})
+	if path := o.machineStoragePath(); path != xdgPath {
+		t.Errorf("expected %q, got %q", xdgPath, path)
+	}
+	if !containsString(o.subprocessEnv(), "MACHINE_STORAGE_PATH="+xdgPath) {
+		t.Errorf("expected docker-machine to be pointed at %q, got %q", xdgPath, o.subprocessEnv())
+	}
+	o = newOptions([]Option{WithRootless(), WithStoragePath("/explicit")})
+	if path := o.machineStoragePath(); path != "/explicit" {
+		t.Errorf("expected WithStoragePath to win, got %q", path)
+	}
+}